@@ -37,6 +37,9 @@ const (
 	BadgerDBBackend BackendType = "badgerdb"
 
 	MongoDBBackend BackendType = "mongodb"
+	// MockMongoDBBackend represents an in-memory stand-in for the MongoDB backend, which is only meant
+	// for fast unit tests. See MockMongoDB for how it differs from a real server.
+	MockMongoDBBackend BackendType = "mockmongo"
 )
 
 type dbCreator func(name string, dir string) (DB, error)
@@ -0,0 +1,70 @@
+package db
+
+import "bytes"
+
+// DiffEntry describes a key whose value differs between two databases. A nil value means that the
+// key is missing from the corresponding database.
+type DiffEntry struct {
+	Key    []byte
+	AValue []byte
+	BValue []byte
+}
+
+// Diff compares the contents of two databases and returns an entry for every key that is missing
+// from either of them or whose values differ, in ascending key order. Both databases are streamed
+// in lockstep through iterators, so only the differences are held in memory.
+//
+// This is mostly useful to validate a backend against a reference implementation.
+func Diff(a, b DB) ([]DiffEntry, error) {
+	itrA, err := a.Iterator(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer itrA.Close()
+
+	itrB, err := b.Iterator(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer itrB.Close()
+
+	var diffs []DiffEntry
+	for itrA.Valid() || itrB.Valid() {
+		cmp := 0
+		switch {
+		case !itrB.Valid():
+			cmp = -1
+		case !itrA.Valid():
+			cmp = 1
+		default:
+			cmp = bytes.Compare(itrA.Key(), itrB.Key())
+		}
+
+		switch {
+		case cmp < 0:
+			diffs = append(diffs, DiffEntry{Key: cp(itrA.Key()), AValue: cp(itrA.Value())})
+			itrA.Next()
+		case cmp > 0:
+			diffs = append(diffs, DiffEntry{Key: cp(itrB.Key()), BValue: cp(itrB.Value())})
+			itrB.Next()
+		default:
+			if !bytes.Equal(itrA.Value(), itrB.Value()) {
+				diffs = append(diffs, DiffEntry{
+					Key:    cp(itrA.Key()),
+					AValue: cp(itrA.Value()),
+					BValue: cp(itrB.Value()),
+				})
+			}
+			itrA.Next()
+			itrB.Next()
+		}
+	}
+
+	if err := itrA.Error(); err != nil {
+		return nil, err
+	}
+	if err := itrB.Error(); err != nil {
+		return nil, err
+	}
+	return diffs, nil
+}
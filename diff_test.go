@@ -0,0 +1,35 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	a := NewMemDB()
+	b := NewMemDB()
+
+	for _, db := range []DB{a, b} {
+		require.NoError(t, db.Set(bz("same"), bz("value")))
+		require.NoError(t, db.Set(bz("empty"), []byte{}))
+	}
+	require.NoError(t, a.Set(bz("changed"), bz("a")))
+	require.NoError(t, b.Set(bz("changed"), bz("b")))
+	require.NoError(t, a.Set(bz("only-a"), bz("a")))
+	require.NoError(t, b.Set(bz("only-b"), bz("b")))
+	require.NoError(t, b.Set(bz("zzz"), bz("b")))
+
+	diffs, err := Diff(a, b)
+	require.NoError(t, err)
+	require.Equal(t, []DiffEntry{
+		{Key: bz("changed"), AValue: bz("a"), BValue: bz("b")},
+		{Key: bz("only-a"), AValue: bz("a")},
+		{Key: bz("only-b"), BValue: bz("b")},
+		{Key: bz("zzz"), BValue: bz("b")},
+	}, diffs)
+
+	diffs, err = Diff(a, a)
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+}
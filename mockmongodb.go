@@ -0,0 +1,277 @@
+package db
+
+import "sync/atomic"
+
+func init() {
+	registerDBCreator(MockMongoDBBackend, func(name, dir string) (DB, error) {
+		return NewMockMongoDB(), nil
+	}, false)
+}
+
+// MockMongoDB is an in-memory database mimicking the semantics of the MongoDB backend, for unit
+// tests which would otherwise need a mongod server. Like MongoDB, it orders keys bytewise,
+// iterates over half-open ranges, rejects empty keys, keys longer than 512 bytes and nil values,
+// returns an empty, non-nil value for keys set to an empty value, and fails with ErrClosed once
+// closed.
+//
+// Unlike MemDB, keys and values are copied in and out as they would be by a round trip to the
+// server, so callers may modify them freely, and iterators read from a snapshot taken when they
+// are created, as a server cursor would, so writes made while an iterator is open neither block
+// nor show up in it.
+//
+// MockMongoDB only covers the DB, Batch and Iterator interfaces. It has none of the features
+// specific to MongoDB, such as the MongoConfig options, TTLs, secondary indexes, transactions
+// and the audit log, and it cannot simulate server errors, network failures, write concerns or
+// replication lag. Tests of these must still run against a real server.
+type MockMongoDB struct {
+	db     *MemDB
+	closed atomic.Bool
+}
+
+var _ DB = (*MockMongoDB)(nil)
+
+// NewMockMongoDB creates a new in-memory stand-in for a MongoDB database.
+func NewMockMongoDB() *MockMongoDB {
+	return &MockMongoDB{db: NewMemDB()}
+}
+
+// Get implements DB.
+func (db *MockMongoDB) Get(key []byte) ([]byte, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	value, err := db.db.Get(key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return cp(value), nil
+}
+
+// Has implements DB.
+func (db *MockMongoDB) Has(key []byte) (bool, error) {
+	if err := db.checkOpen(); err != nil {
+		return false, err
+	}
+	return db.db.Has(key)
+}
+
+// Set implements DB.
+func (db *MockMongoDB) Set(key []byte, value []byte) error {
+	if err := checkMockKey(key); err != nil {
+		return err
+	}
+	if value == nil {
+		return errValueNil
+	}
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	return db.db.Set(cp(key), cp(value))
+}
+
+// SetSync implements DB.
+func (db *MockMongoDB) SetSync(key []byte, value []byte) error {
+	return db.Set(key, value)
+}
+
+// Delete implements DB.
+func (db *MockMongoDB) Delete(key []byte) error {
+	if err := checkMockKey(key); err != nil {
+		return err
+	}
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	return db.db.Delete(key)
+}
+
+// DeleteSync implements DB.
+func (db *MockMongoDB) DeleteSync(key []byte) error {
+	return db.Delete(key)
+}
+
+// Close implements DB. Closing the database again does nothing.
+func (db *MockMongoDB) Close() error {
+	db.closed.Store(true)
+	return nil
+}
+
+// checkOpen returns ErrClosed if the database has been closed.
+func (db *MockMongoDB) checkOpen() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// checkMockKey returns the error MongoDB returns for writing key, if any.
+func checkMockKey(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if len(key) > maxKeySize {
+		return errKeyTooLong
+	}
+	return nil
+}
+
+// Print implements DB.
+func (db *MockMongoDB) Print() error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	return db.db.Print()
+}
+
+// Stats implements DB.
+func (db *MockMongoDB) Stats() map[string]string {
+	stats := db.db.Stats()
+	stats["database.type"] = "mockMongoDB"
+	return stats
+}
+
+// NewBatch implements DB.
+func (db *MockMongoDB) NewBatch() Batch {
+	return &mockMongoDBBatch{db: db, batch: db.db.NewBatch()}
+}
+
+// Iterator implements DB.
+func (db *MockMongoDB) Iterator(start, end []byte) (Iterator, error) {
+	return db.snapshot(start, end, false)
+}
+
+// ReverseIterator implements DB.
+func (db *MockMongoDB) ReverseIterator(start, end []byte) (Iterator, error) {
+	return db.snapshot(start, end, true)
+}
+
+// snapshot returns an iterator over a copy of the pairs in [start, end).
+func (db *MockMongoDB) snapshot(start, end []byte, isReverse bool) (Iterator, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	var (
+		itr Iterator
+		err error
+	)
+	if isReverse {
+		itr, err = db.db.ReverseIterator(start, end)
+	} else {
+		itr, err = db.db.Iterator(start, end)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	var pairs []KV
+	for ; itr.Valid(); itr.Next() {
+		pairs = append(pairs, KV{Key: cp(itr.Key()), Value: cp(itr.Value())})
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+	return &mockMongoDBIterator{pairs: pairs, start: start, end: end}, nil
+}
+
+// mockMongoDBBatch is a MockMongoDB batch, copying keys and values when they are added.
+type mockMongoDBBatch struct {
+	db    *MockMongoDB
+	batch Batch
+}
+
+var _ Batch = (*mockMongoDBBatch)(nil)
+
+// Set implements Batch.
+func (b *mockMongoDBBatch) Set(key, value []byte) error {
+	if err := checkMockKey(key); err != nil {
+		return err
+	}
+	if value == nil {
+		return errValueNil
+	}
+	return b.batch.Set(cp(key), cp(value))
+}
+
+// Delete implements Batch.
+func (b *mockMongoDBBatch) Delete(key []byte) error {
+	if err := checkMockKey(key); err != nil {
+		return err
+	}
+	return b.batch.Delete(cp(key))
+}
+
+// Write implements Batch.
+func (b *mockMongoDBBatch) Write() error {
+	if err := b.db.checkOpen(); err != nil {
+		return err
+	}
+	return b.batch.Write()
+}
+
+// WriteSync implements Batch.
+func (b *mockMongoDBBatch) WriteSync() error {
+	if err := b.db.checkOpen(); err != nil {
+		return err
+	}
+	return b.batch.WriteSync()
+}
+
+// Close implements Batch.
+func (b *mockMongoDBBatch) Close() error {
+	return b.batch.Close()
+}
+
+// mockMongoDBIterator is a MockMongoDB iterator over a snapshot of its range.
+type mockMongoDBIterator struct {
+	pairs []KV
+	start []byte
+	end   []byte
+}
+
+var _ Iterator = (*mockMongoDBIterator)(nil)
+
+// Domain implements Iterator.
+func (itr *mockMongoDBIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements Iterator.
+func (itr *mockMongoDBIterator) Valid() bool {
+	return len(itr.pairs) > 0
+}
+
+// Key implements Iterator.
+func (itr *mockMongoDBIterator) Key() []byte {
+	itr.assertIsValid()
+	return itr.pairs[0].Key
+}
+
+// Value implements Iterator.
+func (itr *mockMongoDBIterator) Value() []byte {
+	itr.assertIsValid()
+	return itr.pairs[0].Value
+}
+
+// Next implements Iterator.
+func (itr *mockMongoDBIterator) Next() {
+	itr.assertIsValid()
+	itr.pairs = itr.pairs[1:]
+}
+
+// Error implements Iterator.
+func (itr *mockMongoDBIterator) Error() error {
+	return nil
+}
+
+// Close implements Iterator.
+func (itr *mockMongoDBIterator) Close() error {
+	itr.pairs = nil
+	return nil
+}
+
+func (itr *mockMongoDBIterator) assertIsValid() {
+	if !itr.Valid() {
+		panic("iterator is invalid")
+	}
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The shared backend suite also runs against MockMongoDB through the backends registry; these run
+// it on its own, since the other subtests of the registry need a mongod server.
+func TestMockMongoDBBackendGetSetDelete(t *testing.T) {
+	testBackendGetSetDelete(t, MockMongoDBBackend)
+}
+
+func TestMockMongoDBIterator(t *testing.T) {
+	testDBIterator(t, MockMongoDBBackend)
+}
+
+func TestMockMongoDBBatch(t *testing.T) {
+	testDBBatch(t, MockMongoDBBackend)
+}
+
+func TestMockMongoDBCopiesKeysAndValues(t *testing.T) {
+	db := NewMockMongoDB()
+
+	key, value := []byte("key"), []byte("value")
+	require.NoError(t, db.Set(key, value))
+	key[0], value[0] = 'x', 'x'
+
+	got, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), got)
+	got[0] = 'x'
+
+	got, err = db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), got)
+
+	require.NoError(t, db.Set([]byte("empty"), []byte{}))
+	got, err = db.Get([]byte("empty"))
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	require.Empty(t, got)
+}
+
+func TestMockMongoDBIteratorSnapshot(t *testing.T) {
+	db := NewMockMongoDB()
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	require.NoError(t, db.Set([]byte("b"), []byte{2}))
+
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+
+	// Writes do not block on the open iterator, and do not show up in it.
+	require.NoError(t, db.Set([]byte("c"), []byte{3}))
+	require.NoError(t, db.Delete([]byte("b")))
+
+	var keys []string
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	require.NoError(t, itr.Error())
+	require.Equal(t, []string{"a", "b"}, keys)
+}
+
+func TestMockMongoDBKeyTooLong(t *testing.T) {
+	db := NewMockMongoDB()
+	long := make([]byte, maxKeySize+1)
+
+	require.Equal(t, errKeyTooLong, db.Set(long, []byte("value")))
+	require.Equal(t, errKeyTooLong, db.Delete(long))
+	batch := db.NewBatch()
+	defer batch.Close()
+	require.Equal(t, errKeyTooLong, batch.Set(long, []byte("value")))
+	require.Equal(t, errKeyTooLong, batch.Delete(long))
+
+	require.NoError(t, db.Set(long[:maxKeySize], []byte("value")))
+}
+
+func TestMockMongoDBClosed(t *testing.T) {
+	db := NewMockMongoDB()
+	require.NoError(t, db.Set([]byte("key"), []byte("value")))
+	batch := db.NewBatch()
+	require.NoError(t, batch.Set([]byte("other"), []byte("value")))
+	require.NoError(t, db.Close())
+	require.NoError(t, db.Close())
+
+	_, err := db.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.Has([]byte("key"))
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, db.SetSync([]byte("key"), []byte("value")), ErrClosed)
+	require.ErrorIs(t, db.Delete([]byte("key")), ErrClosed)
+	_, err = db.Iterator(nil, nil)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.ReverseIterator(nil, nil)
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, batch.Write(), ErrClosed)
+}
@@ -1,127 +1,746 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
+var (
+	// ErrKeyNotFound is returned when an operation requires a key that does not exist.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrClosed is returned by the operations of a MongoDB which has been closed.
+	ErrClosed = errors.New("mongodb database closed")
+
+	// ErrNoExpiry is returned by MongoDB.TTL for keys that never expire.
+	ErrNoExpiry = errors.New("key has no expiry")
+
+	// ErrWriteConcernTimeout is returned by MongoDB.SetSyncW when the write was applied on the
+	// primary, but not acknowledged as requested within MongoConfig.WTimeout. The write is not
+	// rolled back.
+	ErrWriteConcernTimeout = errors.New("write concern timed out")
+)
+
+// DefaultSyncWriteConcern is the write concern of the synchronous write paths when none is
+// configured in MongoConfig.WriteConcern. It may be changed before opening databases. It does not
+// apply to standalone servers, which have no replica set members to wait for.
+var DefaultSyncWriteConcern = writeconcern.Majority()
+
+// standaloneWriteConcern is the default write concern of the synchronous write paths against a
+// standalone server.
+var standaloneWriteConcern = writeconcern.New(writeconcern.W(1), writeconcern.J(true))
+
+// maxKeySize is the size of the longest key which can be written. Servers before MongoDB 4.2
+// reject index entries over 1024 bytes, and the keyHex field indexed for iterators is twice as
+// long as the key. Longer keys are rejected with errKeyTooLong before reaching the server, so
+// that they fail the same way whatever its version.
+const maxKeySize = 512
+
+var errKeyTooLong = fmt.Errorf("key cannot be longer than %d bytes", maxKeySize)
+
+// keyValueProjection restricts returned documents to the binary fields that are decoded into
+// map[string][]byte, leaving out _id and non-binary fields such as expireAt. Values stored in
+// GridFS are referenced by valueRef instead, and read with documentValue.
+var keyValueProjection = bson.M{"_id": 0, "key": 1, "value": 1, "valueRef": 1}
+
 func init() {
 	dbCreator := NewMongoDB
 	registerDBCreator(MongoDBBackend, dbCreator, false)
 }
 
+// MongoConfig holds the configuration of a MongoDB database. The zero value is usable and yields
+// the defaults documented on each field.
+type MongoConfig struct {
+	// URI is the MongoDB connection string. If empty, the MONGODB_URI environment variable is used
+	// instead; an explicit URI always takes precedence over the environment.
+	URI string
+
+	// Database is the name of the MongoDB database holding the collection. If empty, the
+	// MONGODB_DBNAME environment variable is used instead; an explicit name always takes precedence
+	// over the environment. Defaults to "COMETBFT_DB".
+	Database string
+
+	// Collection, if set, is the name of the collection storing the keys, instead of the name the
+	// database is opened with. It lets stores registered under generic names, such as "state", be
+	// co-located in one database under collection names of their own. It is ignored by
+	// MongoDBFactory, whose databases each need a collection of their own. Defaults to the name
+	// of the database.
+	Collection string
+
+	// WriteConcern is used by the synchronous write paths (SetSync, DeleteSync, WriteSync).
+	// Defaults to DefaultSyncWriteConcern, or to acknowledgment by the journal of a standalone
+	// server.
+	WriteConcern *writeconcern.WriteConcern
+
+	// DefaultSync makes the asynchronous write paths (Set, Delete, SetMany, batch Write) behave
+	// like their synchronous counterparts, waiting for WriteConcern, for callers which cannot
+	// choose the synchronous variants themselves. MaxInflightWrites then bounds no write.
+	// Defaults to false.
+	DefaultSync bool
+
+	// WTimeout bounds how long SetSyncW waits for its write concern to be satisfied, after which
+	// it returns ErrWriteConcernTimeout. Defaults to waiting indefinitely.
+	WTimeout time.Duration
+
+	// OperationTimeout bounds each call to the server made by Get, Has, Set, Delete, SetSyncW,
+	// SetMany, DeleteMany, batch writes and iterators, and the ping made when connecting, unless
+	// the context of the call already has a deadline. A call which times out fails with
+	// context.DeadlineExceeded, which is retried as configured by RetryAttempts, each attempt
+	// getting its own timeout; an iterator whose fetch of further keys times out becomes invalid.
+	// It should exceed WTimeout. Defaults to 30 seconds; a negative timeout disables it.
+	OperationTimeout time.Duration
+
+	// ReadPreference selects the replica set members serving reads (Get, Has, iterators): one of
+	// readpref.PrimaryMode, PrimaryPreferredMode, SecondaryMode, SecondaryPreferredMode or
+	// NearestMode. Writes, including SetSync and the reads of batch copies, always go to the
+	// primary. Defaults to the read preference of the URI, or primary.
+	//
+	// Reads served by a secondary trade consistency for capacity: secondaries replicate the
+	// primary asynchronously, so they may return stale values and miss the caller's own recent
+	// writes, even synchronous ones. Bound the lag with MaxStaleness, and use WaitForVisible where
+	// a read must observe a preceding write. Against a standalone server, every mode reads from it.
+	ReadPreference readpref.Mode
+
+	// MaxStaleness bounds how far behind the primary a secondary may be to serve reads. It must
+	// be at least 90 seconds, and requires a ReadPreference other than primary. Defaults to no
+	// bound.
+	MaxStaleness time.Duration
+
+	// ReadYourWrites runs point reads and writes (Get, Has, MultiGet, Set, Delete and batches) in
+	// causally consistent sessions, so that a read observes every write which completed before
+	// it started, even when served by a secondary under ReadPreference: the secondary waits until
+	// it has replicated those writes. The guarantee survives failovers only with majority read
+	// and write concerns. Iterators are not covered, and use WaitForVisible. Defaults to false.
+	ReadYourWrites bool
+
+	// NoCursorTimeout keeps the server cursors of iterators open however long they sit idle
+	// between calls to Next, for long-running scans which would otherwise fail with
+	// ErrCursorNotFound. Such cursors are only freed when the iterator is closed or the server
+	// restarts, so an iterator which is never closed leaks its cursor for good. Defaults to
+	// false.
+	NoCursorTimeout bool
+
+	// IteratorBatchSize is the number of keys iterators fetch from the server at once. The cursor
+	// timeout only runs between fetches, so the time a scan spends processing a batch must stay
+	// below it: smaller batches make it less likely to expire during slow scans, at the cost of
+	// more round trips, while larger ones fetch faster but hold more keys in memory. The server
+	// also caps batches at 16MB. Defaults to the server default: 101 keys for the first batch,
+	// and up to 16MB for the next ones.
+	IteratorBatchSize int32
+
+	// ReadConcern is the read concern of point reads (Get, Has) and, unless IteratorReadConcern is
+	// set, of iterators. Defaults to the read concern of the URI, or the server default.
+	ReadConcern *readconcern.ReadConcern
+
+	// IteratorReadConcern overrides ReadConcern for iterators. Long scans may use
+	// readconcern.Available() to avoid waiting on replication, at the cost of possibly returning
+	// writes that are later rolled back, or that point reads under a stronger read concern do not
+	// see yet. Defaults to ReadConcern.
+	IteratorReadConcern *readconcern.ReadConcern
+
+	// MaxConnIdleTime is how long a pooled connection may stay idle before it is closed rather
+	// than reused, which recycles connections before a load balancer drops them as idle.
+	// Defaults to keeping idle connections open indefinitely.
+	MaxConnIdleTime time.Duration
+
+	// MaxConnecting bounds how many connections the pool establishes concurrently, so that a
+	// burst of operations on an empty pool waits for connections to become available instead of
+	// opening many at once. Defaults to 2.
+	MaxConnecting uint64
+
+	// MaxPoolSize bounds the number of connections of the pool to each server, operations waiting
+	// for a connection to be returned once it is reached. Defaults to 100.
+	MaxPoolSize uint64
+
+	// MinPoolSize is the number of connections to each server the pool keeps open, even when
+	// idle, so that bursts of operations do not wait for connections to be established. It must
+	// not exceed MaxPoolSize. Defaults to 0.
+	MinPoolSize uint64
+
+	// TLSConfig secures the connections to the server with TLS, overriding the TLS options of the
+	// URI. It lets certificates and certificate authorities be loaded from memory, for instance
+	// from a secrets manager, rather than referenced by file paths in the URI. Defaults to the TLS
+	// options of the URI.
+	TLSConfig *tls.Config
+
+	// Logger receives the backend's log messages. Connection strings are always sanitized with
+	// SanitizeMongoURI before being logged. Defaults to discarding all messages.
+	Logger Logger
+
+	// Metrics receives the backend's measurements, for instance a PrometheusMetrics. Defaults to
+	// discarding them.
+	Metrics Metrics
+
+	// KeyAsID stores every key as the _id of its document, in addition to the key field, so that
+	// point lookups go straight through the primary index instead of a secondary index on key,
+	// which is then not created. Iterators still walk the keyHex index. The layout is recorded
+	// when the collection is created, and opening it with a different setting fails with
+	// ErrLayoutMismatch. Defaults to false.
+	KeyAsID bool
+
+	// PrefixTTLs maps key prefixes to how long keys with that prefix live after being written. A
+	// key set without an explicit TTL expires after the TTL of the longest prefix it starts with,
+	// or never if it starts with none. Expired keys are removed by the server's TTL monitor,
+	// which runs every minute. Defaults to no rules.
+	PrefixTTLs map[string]time.Duration
+
+	// PurgeOnClose makes Close delete the keys which have expired but are still waiting for the
+	// server's TTL monitor, which only runs every minute, for instance when tearing down tests
+	// or ephemeral nodes. Defaults to false.
+	PurgeOnClose bool
+
+	// KeyValidator, if set, is called with the key of every write (Set, Delete, batch and
+	// transaction operations, Increment), which fails with the returned error if it is not nil.
+	// Keys are only validated when written, so keys already stored are still read. Defaults to no
+	// validation. Keys longer than 512 bytes are always rejected, before KeyValidator is called.
+	KeyValidator func(key []byte) error
+
+	// SecondaryIndex, if set, maps every value written to a secondary field which is stored and
+	// indexed alongside the key, so that values can be looked up by it with GetBySecondary. An
+	// empty field leaves the value out of the index. This costs a call to SecondaryIndex and an
+	// update of the secondary index on every write. Defaults to no secondary index.
+	SecondaryIndex func(value []byte) string
+
+	// RetryAttempts is the number of times a failed operation is retried when the error is
+	// classified as transient by IsTransient, such as a network error or a primary step-down.
+	// Other errors, such as duplicate keys or failed validations, are returned immediately.
+	// Defaults to 3; a negative number disables retries.
+	RetryAttempts int
+
+	// RetryBaseDelay is how long the first retry of an operation waits after the failure, each
+	// further retry waiting twice as long as the previous one, up to 5 seconds. Defaults to 100
+	// milliseconds.
+	RetryBaseDelay time.Duration
+
+	// ShouldRetry, if set, replaces the default retry classification. It is called after each
+	// failed attempt with the error and the number of attempts made so far (starting at 1), and
+	// the operation is retried, after the delay given by RetryBaseDelay, for as long as it returns
+	// true. RetryAttempts is ignored when ShouldRetry is set.
+	ShouldRetry func(err error, attempt int) bool
+
+	// BreakerThreshold, if positive, enables a circuit breaker which opens after that many
+	// operations in a row have failed with a transient error, as classified by IsTransient, once
+	// retries are exhausted. While open, operations fail immediately with ErrCircuitOpen. Every
+	// BreakerCooldown a single operation is let through to probe the server, and the breaker
+	// closes again once one succeeds. Defaults to 0 (no circuit breaker).
+	BreakerThreshold int
+
+	// BreakerCooldown is how long an open circuit breaker waits before probing the server.
+	// Defaults to 10 seconds.
+	BreakerCooldown time.Duration
+
+	// Comment, if set, is called for every Get, Has, Set, Delete, batch write and iterator, and
+	// the comment it returns is attached to the issued command. Comments show up in the server's
+	// profiler and slow query log, so for instance returning the height of the block being
+	// processed ties slow queries back to it. Return a constant for a static comment, or "" for
+	// none. Defaults to no comment.
+	Comment func() string
+
+	// MaxInflightWrites, if positive, bounds the number of asynchronous writes (Set, Delete) in
+	// flight at once, which otherwise grows with the number of writing goroutines. Writes beyond
+	// the limit block until an earlier one completes, providing backpressure under bursts of
+	// load, or fail with ErrTooManyInflightWrites if RejectInflightWrites is set. Synchronous
+	// writes are not bounded. Defaults to 0 (no bound).
+	MaxInflightWrites int
+
+	// RejectInflightWrites makes writes beyond MaxInflightWrites fail rather than block.
+	RejectInflightWrites bool
+
+	// BulkWriteChunkSize is the maximum number of operations sent in a single bulk write by batch
+	// writes and SetMany, which split larger writes into consecutive bulk writes, keeping their
+	// order. The server accepts at most 100,000 operations per bulk write. If one of the bulk
+	// writes fails, the operations of those before it remain applied. Defaults to 1000.
+	BulkWriteChunkSize int
+
+	// AuditLog, if set, is the name of a collection of the same database to which an entry is
+	// appended for every Set, Delete and batch operation, within the same transaction for those
+	// of a MongoDBTxn. Entries record the key, whether it had a value before, the SHA-256 hash
+	// of the new value, and the time of the mutation. Every mutation then costs an additional
+	// insert, and every batch write an additional query for the keys it mutates. The audit log is
+	// only appended to, so it grows without bound. Defaults to no audit log.
+	AuditLog string
+
+	// BestEffortIndexes makes opening a collection log failures to create its indexes and carry
+	// on without them, rather than fail, for deployments where index creation is denied or over
+	// quota, such as Atlas shared tiers. Without the key index every Get, Has and write scans the
+	// collection, without the keyHex index iterators sort in memory, which fails on large ranges,
+	// and without the expireAt index expired keys are never removed by the server. Indexes which
+	// already exist are never created again, so no privilege is needed to open a collection whose
+	// indexes were created beforehand, for instance by an administrator. Defaults to false.
+	BestEffortIndexes bool
+
+	// CommandMonitor, if set, is notified of every command sent to the server.
+	CommandMonitor *event.CommandMonitor
+
+	// readOnly opens the collection without writing to it, as done by NewReadOnlyMongoDB.
+	readOnly bool
+}
+
 type MongoDB struct {
-	client         *mongo.Client
-	databaseName   string
-	collectionName string
-	collection     *mongo.Collection
-	syncCollection *mongo.Collection // For synchronous operations
+	client          *mongo.Client
+	pool            *poolStats // Statistics of the connection pool of client
+	databaseName    string
+	collectionName  string
+	collection      MongoCollection
+	syncCollection  MongoCollection // For synchronous operations
+	readCollection  MongoCollection // For reads, using the configured read preference
+	iterCollection  MongoCollection // For iterators, using the configured iterator read concern
+	config          MongoConfig
+	openIterators   atomic.Int64
+	breaker         *circuitBreaker   // Nil if no circuit breaker is configured
+	auditCollection *mongo.Collection // Nil if no audit log is configured
+	inflight        *inflightLimiter  // Nil if in-flight writes are not bounded
+	ownsClient      bool              // Whether Close disconnects client, which is shared otherwise
+	closed          atomic.Bool
+	active          activeOps    // The operations in progress, which Close waits for
+	clock           *causalClock // Nil unless MongoConfig.ReadYourWrites is set
 }
 
 var _ DB = (*MongoDB)(nil)
 
+// NewMongoDB opens the collection name on the server at uri, or at the MONGODB_URI environment
+// variable if uri is empty.
 func NewMongoDB(name string, uri string) (DB, error) {
 	return NewMongoDBWithOpts(name, uri, nil)
 }
 
 func NewMongoDBWithOpts(name string, uri string, wc *writeconcern.WriteConcern) (DB, error) {
+	return NewMongoDBWithConfig(name, MongoConfig{URI: uri, WriteConcern: wc})
+}
+
+// NewReadOnlyMongoDB opens the collection name for reading only, for instance on dedicated read
+// replicas. Writes fail with ErrReadOnly. Reads and iterators are served by secondaries when any
+// are available, with the "available" read concern, so they may return stale data or writes
+// which are later rolled back. Opening the collection neither creates its indexes nor records
+// its layout, which must have been done by a writable handle.
+func NewReadOnlyMongoDB(name string, uri string) (DB, error) {
+	db, err := NewMongoDBWithConfig(name, MongoConfig{
+		URI:            uri,
+		ReadPreference: readpref.SecondaryPreferredMode,
+		ReadConcern:    readconcern.Available(),
+		readOnly:       true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewReadOnlyDB(db), nil
+}
 
-	uriENV := os.Getenv("MONGODB_URI")
-	if uriENV != "" {
-		uri = uriENV
+// NewMongoDBWithConfig creates a MongoDB database storing its keys in the collection name, or in
+// cfg.Collection if set.
+func NewMongoDBWithConfig(name string, cfg MongoConfig) (DB, error) {
+	client, pool, dbName, err := connectMongo(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openMongoDB(client, pool, dbName, name, cfg)
+	if err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
 	}
-	dbName := os.Getenv("MONGODB_DBNAME")
-	if dbName == "" {
-		dbName = "COMETBFT_DB"
+	db.ownsClient = true
+	return db, nil
+}
+
+// NewMongoDBWithClient opens the collection name of the database dbName using client, which is
+// already connected, so that a process opening several stores on the same cluster can share one
+// client and its connection pool between them, as with a MongoDBFactory. An empty dbName is
+// resolved as by NewMongoDB. The default configuration applies, apart from the options of the
+// client itself, and the pool statistics of Stats are left out.
+//
+// The client is owned by the caller: closing the returned database does not disconnect it, and
+// it must stay connected for as long as the database is used.
+func NewMongoDBWithClient(name string, client *mongo.Client, dbName string) (DB, error) {
+	if client == nil {
+		return nil, errors.New("no mongo client given")
 	}
+	dbName = resolveDatabaseName(dbName)
+	cfg := MongoConfig{}
+	cfg.setDefaults()
 
-	sanitizedURI, err := SanitizeMongoURI(uri)
+	ctx, cancel := operationContext(context.Background(), cfg.OperationTimeout)
+	defer cancel()
+	if err := cfg.setServerDefaults(ctx, client, dbName); err != nil {
+		return nil, err
+	}
+	return openMongoDB(client, nil, dbName, name, cfg)
+}
+
+// resolveMongoURI returns the connection string to use: uri if non-empty, and otherwise the
+// MONGODB_URI environment variable.
+func resolveMongoURI(uri string) (string, error) {
+	if uri != "" {
+		return uri, nil
+	}
+	if uri = os.Getenv("MONGODB_URI"); uri != "" {
+		return uri, nil
+	}
+	return "", errors.New("no mongo uri given, and MONGODB_URI is not set")
+}
+
+// connectMongo connects to the server configured by cfg, and returns the client, the statistics of
+// its connection pool and the name of the database to use. It fills in the defaults of cfg which
+// depend on the server.
+func connectMongo(cfg *MongoConfig) (*mongo.Client, *poolStats, string, error) {
+	uri, err := resolveMongoURI(cfg.URI)
 	if err != nil {
-		return nil, fmt.Errorf("invalid mongo uri %v", uri)
+		return nil, nil, "", err
 	}
+	dbName := resolveDatabaseName(cfg.Database)
 
-	clientOptions := options.Client().ApplyURI(uri)
+	if _, err := cfg.readPreference(); err != nil {
+		return nil, nil, "", err
+	}
 
-	client, err := mongo.Connect(context.Background(), clientOptions)
+	sanitizedURI, err := SanitizeMongoURI(uri)
 	if err != nil {
-		return nil, err
+		return nil, nil, "", fmt.Errorf("invalid mongo uri: %w", err)
+	}
+
+	opts := cfg.clientOptions(uri)
+	pool := &poolStats{maxSize: defaultMaxPoolSize}
+	if opts.MaxPoolSize != nil {
+		pool.maxSize = *opts.MaxPoolSize
+	}
+	client, err := mongo.Connect(context.Background(), opts.SetPoolMonitor(pool.monitor()))
+	if err != nil {
+		return nil, nil, "", err
 	}
 
+	cfg.setDefaults()
+
 	// Check the connection
-	err = client.Ping(context.Background(), nil)
+	ctx, cancel := operationContext(context.Background(), cfg.OperationTimeout)
+	defer cancel()
+	err = client.Ping(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("unable to connect to mongo: %v: %v", dbName, sanitizedURI)
+		cfg.Logger.Error("Unable to connect to MongoDB", "uri", sanitizedURI, "database", dbName, "err", err)
+		_ = client.Disconnect(context.Background())
+		return nil, nil, "", fmt.Errorf("unable to connect to mongo: %v: %v", dbName, sanitizedURI)
 	}
+	cfg.Logger.Info("Connected to MongoDB", "uri", sanitizedURI, "database", dbName)
 
-	collection := client.Database(dbName).Collection(name)
+	if err := cfg.setServerDefaults(ctx, client, dbName); err != nil {
+		return nil, nil, "", err
+	}
+	return client, pool, dbName, nil
+}
 
-	if wc == nil {
-		// Set to majority write concern if none is provided
-		wc = writeconcern.Majority()
+// resolveDatabaseName returns the name of the database to use: name if non-empty, and otherwise
+// the MONGODB_DBNAME environment variable, or COMETBFT_DB if it is not set either.
+func resolveDatabaseName(name string) string {
+	if name == "" {
+		name = os.Getenv("MONGODB_DBNAME")
+	}
+	if name == "" {
+		name = "COMETBFT_DB"
 	}
+	return name
+}
 
-	// Create a syncCollection with the provided or default write concern
-	syncCollection := client.Database(dbName).Collection(name, options.Collection().SetWriteConcern(wc))
+// setDefaults fills in the defaults of cfg which do not depend on the server.
+func (cfg *MongoConfig) setDefaults() {
+	if cfg.Logger == nil {
+		cfg.Logger = nopLogger{}
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = nopMetrics{}
+	}
+}
+
+// setServerDefaults fills in the defaults of cfg which depend on the server client is connected
+// to.
+func (cfg *MongoConfig) setServerDefaults(ctx context.Context, client *mongo.Client, dbName string) error {
+	if cfg.WriteConcern != nil {
+		return nil
+	}
+	standalone, err := isStandalone(ctx, client)
+	if err != nil {
+		return err
+	}
+	if standalone {
+		// There is no replica set to wait for, so only wait for the server's journal.
+		cfg.WriteConcern = standaloneWriteConcern
+		cfg.Logger.Info("Connected to a standalone MongoDB server, sync writes only wait for the journal",
+			"database", dbName)
+	} else {
+		cfg.WriteConcern = DefaultSyncWriteConcern
+	}
+	return nil
+}
 
-	err = ensureIndex(collection, "key")
+// openMongoDB opens the database storing its keys in the collection name of the database dbName,
+// or in cfg.Collection if set, using client and its pool statistics as connected by connectMongo
+// with cfg.
+func openMongoDB(client *mongo.Client, pool *poolStats, dbName, name string, cfg MongoConfig) (*MongoDB, error) {
+	readPref, err := cfg.readPreference()
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Collection != "" {
+		name = cfg.Collection
+	}
+
+	mongoDatabase := client.Database(dbName)
+	// The collections used for writes also serve the reads writes depend on, such as those of
+	// batch copies, so they read from the primary whatever the read preference of the URI.
+	collection := mongoDatabase.Collection(name, options.Collection().SetReadPreference(readpref.Primary()))
+
+	// Create a syncCollection with the provided or default write concern
+	syncCollection := mongoDatabase.Collection(name, options.Collection().
+		SetReadPreference(readpref.Primary()).
+		SetWriteConcern(cfg.WriteConcern))
+
+	readCollection := mongoDatabase.Collection(name, cfg.readCollectionOptions(readPref))
+	iterCollection := mongoDatabase.Collection(name, cfg.iteratorCollectionOptions(readPref))
 
-	err = ensureIndex(collection, "keyHex")
+	if cfg.readOnly {
+		err = verifyLayout(context.Background(), readCollection, cfg.layout())
+	} else {
+		err = prepareCollection(collection, syncCollection, cfg)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	database := &MongoDB{
-		client:         client,
-		databaseName:   name,
-		collectionName: name,
-		collection:     collection,
-		syncCollection: syncCollection,
+		client:          client,
+		pool:            pool,
+		databaseName:    dbName,
+		collectionName:  name,
+		collection:      collection,
+		syncCollection:  syncCollection,
+		readCollection:  readCollection,
+		iterCollection:  iterCollection,
+		config:          cfg,
+		auditCollection: auditCollectionFor(mongoDatabase, cfg),
+	}
+	if cfg.BreakerThreshold > 0 {
+		database.breaker = newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+	if cfg.MaxInflightWrites > 0 {
+		database.inflight = newInflightLimiter(cfg.MaxInflightWrites, cfg.RejectInflightWrites)
+	}
+	if cfg.ReadYourWrites {
+		database.clock = &causalClock{}
+	}
+	if !cfg.readOnly {
+		if err := database.upgradeSchema(context.Background()); err != nil {
+			return nil, err
+		}
 	}
 
 	return database, nil
 }
 
+// CollectionName returns the name of the collection storing the keys.
+func (db *MongoDB) CollectionName() string {
+	return db.collectionName
+}
+
 func (db *MongoDB) NewBatch() Batch {
-	return newMongoDBBatch(db.collection, db.syncCollection)
+	return newMongoDBBatch(db)
+}
+
+// NewBatchWithSize is like NewBatch, but allocates room for n operations upfront, so that a batch
+// whose number of operations is roughly known, such as that of a block, does not grow repeatedly.
+// The batch still grows past n operations as needed.
+func (db *MongoDB) NewBatchWithSize(n int) Batch {
+	batch := newMongoDBBatch(db)
+	if n > 0 {
+		batch.ops = make([]mongo.WriteModel, 0, n)
+		batch.mutations = make([]mutation, 0, n)
+	}
+	return batch
 }
 
 func (db *MongoDB) Get(key []byte) ([]byte, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but gives up once ctx is done.
+func (db *MongoDB) GetContext(ctx context.Context, key []byte) (_ []byte, err error) {
 	if len(key) == 0 {
 		return nil, errKeyEmpty
 	}
-	filter := bson.M{"key": key}
+	defer db.observe("get", time.Now(), &err)
+	filter := unexpired(db.keyFilter(key))
 	var result map[string][]byte
-	projection := options.FindOne().SetProjection(bson.M{"_id": 0})
-
-	err := db.collection.FindOne(context.Background(), filter, projection).Decode(&result)
+	projection := options.FindOne().SetProjection(keyValueProjection)
+	if comment := db.comment(); comment != "" {
+		projection.SetComment(comment)
+	}
 
-	if err != nil {
+	err = db.retry(func() error {
+		ctx, cancel := db.consistentContext(ctx)
+		defer cancel()
+		err := db.readCollection.FindOne(ctx, filter, projection).Decode(&result)
 		if err == mongo.ErrNoDocuments {
-			return nil, nil
+			// A missing key is a result, not a failure to retry.
+			result = nil
+			return nil
 		}
+		return err
+	})
+	if err != nil || result == nil {
 		return nil, err
 	}
-	return result["value"], nil
+	return db.documentValue(ctx, result)
 }
 
-func (db *MongoDB) Has(key []byte) (bool, error) {
-	bytes, err := db.Get(key)
+// GetOrErr is like Get, but returns ErrKeyNotFound for a missing key instead of a nil value, so
+// that strict callers cannot mistake a missing key for an empty value, which Get returns as a
+// non-nil empty slice.
+func (db *MongoDB) GetOrErr(key []byte) ([]byte, error) {
+	value, err := db.Get(key)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	if value == nil {
+		return nil, fmt.Errorf("%X: %w", key, ErrKeyNotFound)
+	}
+	return value, nil
+}
+
+// MultiGet returns the values of keys in a single round trip, in the order of keys, with nil for
+// the keys which do not exist. Like Get, it treats expired keys as missing.
+func (db *MongoDB) MultiGet(keys [][]byte) (_ [][]byte, err error) {
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, errKeyEmpty
+		}
+	}
+	values := make([][]byte, len(keys))
+	if len(keys) == 0 {
+		return values, nil
+	}
+	defer db.observe("multi_get", time.Now(), &err)
+
+	opts := options.Find().SetProjection(keyValueProjection)
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+	// The server returns documents in no particular order.
+	found := make(map[string][]byte, len(keys))
+	err = db.retry(func() error {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		cursor, err := db.readCollection.Find(ctx, unexpired(db.keysFilter(keys)), opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		for cursor.Next(ctx) {
+			var doc map[string][]byte
+			if err := cursor.Decode(&doc); err != nil {
+				return err
+			}
+			value, err := db.documentValue(ctx, doc)
+			if err != nil {
+				return err
+			}
+			found[string(doc["key"])] = value
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		values[i] = found[string(key)]
+	}
+	return values, nil
+}
+
+// unexpired restricts filter to the keys which have not expired. The server's TTL monitor only
+// removes expired keys periodically, once a minute by default, so reads filter them out.
+func unexpired(filter bson.M) bson.M {
+	filter["$or"] = bson.A{
+		bson.M{"expireAt": bson.M{"$exists": false}},
+		bson.M{"expireAt": bson.M{"$gt": time.Now()}},
+	}
+	return filter
+}
+
+// Has implements DB. Only the _id of the document of key is fetched, so the check costs the same
+// whatever the size of the value. Like Get, it treats expired keys as missing, as well as the
+// valueless document of a counter started by earlier versions, which wrote its value separately.
+func (db *MongoDB) Has(key []byte) (_ bool, err error) {
+	if len(key) == 0 {
+		return false, errKeyEmpty
+	}
+	defer db.observe("has", time.Now(), &err)
+	filter := unexpired(db.keyFilter(key))
+	filter["$and"] = bson.A{bson.M{"$or": bson.A{
+		bson.M{"value": bson.M{"$exists": true}},
+		bson.M{"valueRef": bson.M{"$exists": true}},
+	}}}
+	opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+
+	found := false
+	err = db.retry(func() error {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		err := db.readCollection.FindOne(ctx, filter, opts).Err()
+		if err == mongo.ErrNoDocuments {
+			// A missing key is a result, not a failure to retry.
+			found = false
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	return found, err
+}
+
+// visibilityPollInterval is how often WaitForVisible checks for the key.
+const visibilityPollInterval = 10 * time.Millisecond
+
+// WaitForVisible waits until key can be read through the configured read preference and read
+// concern, polling for it, and returns an error if it is still not visible after timeout. Writes
+// are only guaranteed to be visible to reads from the primary once acknowledged, so this gives
+// read-your-writes behavior to reads which may be served by secondaries.
+func (db *MongoDB) WaitForVisible(key []byte, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := db.Has(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("key %X not visible after %v", key, timeout)
+		}
+		time.Sleep(visibilityPollInterval)
 	}
-	return bytes != nil, nil
 }
 
 func (db *MongoDB) Set(key []byte, value []byte) error {
@@ -140,115 +759,1579 @@ func (db *MongoDB) DeleteSync(key []byte) error {
 	return db.delete(key, true)
 }
 
+// SetContext is like Set, but gives up once ctx is done, in which case the write may or may not
+// have been applied.
+func (db *MongoDB) SetContext(ctx context.Context, key []byte, value []byte) error {
+	return db.setWithExpiry(ctx, key, value, time.Time{}, false)
+}
+
 func (db *MongoDB) set(key []byte, value []byte, sync bool) error {
+	return db.setWithExpiry(context.Background(), key, value, time.Time{}, sync)
+}
+
+// SetSyncW sets the value for the given key, and waits until the write is acknowledged as
+// requested by w, which is either the number of replica set members (at least 1) or the name of a
+// tag set defined in the replica set configuration, such as "majority". If the acknowledgment does
+// not happen within MongoConfig.WTimeout, ErrWriteConcernTimeout is returned.
+func (db *MongoDB) SetSyncW(key []byte, value []byte, w interface{}) (err error) {
 	if len(key) == 0 {
 		return errKeyEmpty
 	}
+	if err := db.validateKey(key); err != nil {
+		return err
+	}
 	if value == nil {
 		return errValueNil
 	}
+	defer db.observe("set", time.Now(), &err)
 
-	collection := db.collection
-	if sync {
-		collection = db.syncCollection
+	wc, err := writeConcernFor(w, db.config.WTimeout)
+	if err != nil {
+		return err
+	}
+	collection, err := withWriteConcern(db.collection, wc)
+	if err != nil {
+		return err
+	}
+	update, err := db.valueUpdate(context.Background(), key, value, time.Time{})
+	if err != nil {
+		return err
 	}
 
-	updateOpts := &options.UpdateOptions{}
-	updateOpts.SetUpsert(true)
-	_, err := collection.UpdateOne(
-		context.Background(),
-		bson.M{"key": key},
-		bson.M{"$set": bson.M{"value": value, "keyHex": hex.EncodeToString(key)}},
-		updateOpts,
-	)
-
-	return err
+	var result *mongo.UpdateResult
+	err = db.retry(func() error {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		result, err = collection.UpdateOne(
+			ctx,
+			db.keyFilter(key),
+			update,
+			options.Update().SetUpsert(true),
+		)
+		return err
+	})
+	if isWTimeout(err) {
+		return fmt.Errorf("%w: %v", ErrWriteConcernTimeout, err)
+	}
+	if err != nil {
+		return err
+	}
+	return db.audit(context.Background(), mutation{key, value}, result.MatchedCount > 0)
 }
 
-func (db *MongoDB) delete(key []byte, sync bool) error {
-	if len(key) == 0 {
-		return errKeyEmpty
+// writeConcernFor builds the write concern waiting for the acknowledgment of w, either a number
+// of members or a tag set name, for at most wtimeout if it is positive.
+func writeConcernFor(w interface{}, wtimeout time.Duration) (*writeconcern.WriteConcern, error) {
+	opts := []writeconcern.Option{}
+	switch w := w.(type) {
+	case int:
+		if w < 1 {
+			return nil, fmt.Errorf("write concern must require at least 1 member, got %d", w)
+		}
+		opts = append(opts, writeconcern.W(w))
+	case string:
+		if w == "" {
+			return nil, errors.New("write concern tag set cannot be empty")
+		}
+		opts = append(opts, writeconcern.WTagSet(w))
+	default:
+		return nil, fmt.Errorf("write concern must be a number of members or a tag set, got %T", w)
 	}
-
-	collection := db.collection
-	if sync {
-		collection = db.syncCollection
+	if wtimeout > 0 {
+		opts = append(opts, writeconcern.WTimeout(wtimeout))
 	}
-
-	_, err := collection.DeleteOne(context.Background(), bson.M{"key": key})
-	return err
+	return writeconcern.New(opts...), nil
 }
 
-func (db *MongoDB) Close() error {
-	return nil // MongoDB driver handles connection pooling
+// isWTimeout reports whether err is a write concern error caused by the write concern timeout.
+func isWTimeout(err error) bool {
+	var we mongo.WriteException
+	if !errors.As(err, &we) || we.WriteConcernError == nil {
+		return false
+	}
+	// WriteConcernFailed, which the server only reports for a wtimeout.
+	return we.WriteConcernError.Code == 64
 }
 
-func (db *MongoDB) Print() error {
-	return nil
-	// Implementation here
+// SetWithTTL sets the value for the given key, and marks it as expiring once ttl has elapsed,
+// regardless of MongoConfig.PrefixTTLs. The remaining time can be read back with TTL. Setting the
+// key again without a TTL removes the expiry, unless one of MongoConfig.PrefixTTLs applies.
+//
+// Expired keys are removed by the server's TTL monitor, which runs once a minute by default. Get
+// and Has treat keys as missing as soon as they expire, but until the monitor removes them they
+// are still returned by iterators.
+func (db *MongoDB) SetWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+	return db.setWithExpiry(context.Background(), key, value, time.Now().Add(ttl), false)
 }
 
-func (db *MongoDB) Stats() map[string]string {
-	return nil
-	// Implementation here
+// TTL returns the time remaining until the given key expires, or zero if it has already expired.
+// It returns ErrNoExpiry if the key never expires, and ErrKeyNotFound if the key does not exist.
+func (db *MongoDB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, errKeyEmpty
+	}
+
+	var result struct {
+		ExpireAt *time.Time `bson:"expireAt"`
+	}
+	projection := options.FindOne().SetProjection(bson.M{"_id": 0, "expireAt": 1})
+	err := db.retry(func() error {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		return db.readCollection.FindOne(ctx, db.keyFilter(key), projection).Decode(&result)
+	})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return 0, ErrKeyNotFound
+		}
+		return 0, err
+	}
+	if result.ExpireAt == nil {
+		return 0, ErrNoExpiry
+	}
+
+	remaining := time.Until(*result.ExpireAt)
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
 }
 
-func ensureIndex(collection *mongo.Collection, indexKey string) error {
-	// List existing indexes
-	cursor, err := collection.Indexes().List(context.Background())
+// setWithExpiry sets the value for the given key, expiring it at expireAt unless it is zero.
+func (db *MongoDB) setWithExpiry(ctx context.Context, key []byte, value []byte, expireAt time.Time,
+	sync bool) (err error) {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	sync = sync || db.config.DefaultSync
+	if err := db.validateKey(key); err != nil {
+		return err
+	}
+	if value == nil {
+		return errValueNil
+	}
+	defer db.observe("set", time.Now(), &err)
+
+	collection := db.collection
+	if sync {
+		collection = db.syncCollection
+	} else {
+		release, err := db.acquireWrite(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	updateOpts := &options.UpdateOptions{}
+	updateOpts.SetUpsert(true)
+	if comment := db.comment(); comment != "" {
+		updateOpts.SetComment(comment)
+	}
+	update, err := db.valueUpdate(ctx, key, value, expireAt)
 	if err != nil {
 		return err
 	}
-	var existingIndexes []bson.M
-	if err = cursor.All(context.Background(), &existingIndexes); err != nil {
+	var result *mongo.UpdateResult
+	err = db.retry(func() (err error) {
+		ctx, cancel := db.consistentContext(ctx)
+		defer cancel()
+		result, err = collection.UpdateOne(
+			ctx,
+			db.keyFilter(key),
+			update,
+			updateOpts,
+		)
+		return err
+	})
+	if err != nil {
 		return err
 	}
+	return db.audit(ctx, mutation{key, value}, result.MatchedCount > 0)
+}
 
-	// Check if the index already exists
-	for _, index := range existingIndexes {
-		if indexKeyMap, ok := index["key"].(bson.M); ok {
-			if _, exists := indexKeyMap[indexKey]; exists {
-				// Index already exists, no need to create
-				return nil
-			}
+// setUpdate builds the update document storing value under key. The key expires at expireAt, or
+// if expireAt is zero as configured by MongoConfig.PrefixTTLs. The server stamps the document
+// with its modification time in updatedAt, which RecentKeys relies on. Any counter maintained by
+// Increment is dropped, since value replaces the counter's encoding.
+func (db *MongoDB) setUpdate(key []byte, value []byte, expireAt time.Time) bson.M {
+	fields := bson.M{"value": value, "keyHex": hex.EncodeToString(key)}
+	if db.config.KeyAsID {
+		// Upserts only copy the _id from the filter.
+		fields["key"] = key
+	}
+	unset := bson.M{"counter": "", "valueRef": ""}
+	if expireAt.IsZero() {
+		expireAt = db.prefixExpiry(key, time.Now())
+	}
+	if expireAt.IsZero() {
+		unset["expireAt"] = ""
+	} else {
+		fields["expireAt"] = expireAt
+	}
+	if db.config.SecondaryIndex != nil {
+		if secondary := db.config.SecondaryIndex(value); secondary != "" {
+			fields["secondary"] = secondary
+		} else {
+			unset["secondary"] = ""
 		}
 	}
 
-	// Create the index since it doesn't exist
-	indexModel := mongo.IndexModel{
-		Keys: bson.M{indexKey: 1}, // 1 for ascending
+	return bson.M{
+		"$set":         fields,
+		"$unset":       unset,
+		"$currentDate": bson.M{"updatedAt": true},
 	}
-	_, err = collection.Indexes().CreateOne(context.Background(), indexModel)
-	return err
 }
 
-// SanitizeMongoURI removes the username and password from a MongoDB URI.
-func SanitizeMongoURI(originalURI string) (string, error) {
-	// Parse the original URI
-	u, err := url.Parse(originalURI)
-	if err != nil {
-		return "", err
+// prefixExpiry returns when key written at now expires according to MongoConfig.PrefixTTLs, or
+// the zero time if it does not expire. The longest matching prefix wins.
+func (db *MongoDB) prefixExpiry(key []byte, now time.Time) time.Time {
+	longest := -1
+	var ttl time.Duration
+	for prefix, prefixTTL := range db.config.PrefixTTLs {
+		if len(prefix) > longest && bytes.HasPrefix(key, []byte(prefix)) {
+			longest, ttl = len(prefix), prefixTTL
+		}
 	}
+	if longest < 0 {
+		return time.Time{}
+	}
+	return now.Add(ttl)
+}
 
-	if u.Scheme != "mongodb" && u.Scheme != "mongodb+srv" {
-		return "", errors.New("invalid scheme")
+// GetBySecondary returns the values of all keys whose value was mapped to field by the configured
+// MongoConfig.SecondaryIndex, in key order, leaving out expired keys like Get. It returns an error
+// if no secondary index is configured.
+func (db *MongoDB) GetBySecondary(field string) ([][]byte, error) {
+	if db.config.SecondaryIndex == nil {
+		return nil, errors.New("no secondary index is configured")
 	}
 
-	// Remove username and password
-	u.User = nil
+	opts := options.Find().SetSort(iteratorSort(1)).SetProjection(keyValueProjection)
+	var values [][]byte
+	err := db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		cursor, err := db.readCollection.Find(ctx, unexpired(bson.M{"secondary": field}), opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
 
-	// Reconstruct the URI
-	sanitizedURI := fmt.Sprintf(
-		"%s://%s%s",
-		u.Scheme,
-		u.Host,
+		values = nil
+		for cursor.Next(ctx) {
+			var doc map[string][]byte
+			if err := cursor.Decode(&doc); err != nil {
+				return err
+			}
+			value, err := db.documentValue(ctx, doc)
+			if err != nil {
+				return err
+			}
+			values = append(values, value)
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// KeyMeta describes when a key was last modified.
+type KeyMeta struct {
+	Key       []byte
+	UpdatedAt time.Time
+}
+
+// RecentKeys returns the n most recently modified keys, newest first.
+//
+// Modification times are tracked in each document's updatedAt field, stamped by the server with
+// millisecond precision on every Set; keys modified within the same millisecond are ordered by
+// insertion. Documents written without updatedAt (e.g. by older versions) sort last. The field
+// is not indexed to keep writes cheap, so this scans the collection and is meant for debugging.
+func (db *MongoDB) RecentKeys(n int) ([]KeyMeta, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("n must be positive, got %d", n)
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "updatedAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetLimit(int64(n)).
+		SetProjection(bson.M{"_id": 0, "key": 1, "updatedAt": 1})
+	filter, err := rangeFilter(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var docs []struct {
+		Key       []byte    `bson:"key"`
+		UpdatedAt time.Time `bson:"updatedAt"`
+	}
+	err = db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		cursor, err := db.readCollection.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		return cursor.All(ctx, &docs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]KeyMeta, 0, len(docs))
+	for _, doc := range docs {
+		keys = append(keys, KeyMeta{Key: doc.Key, UpdatedAt: doc.UpdatedAt})
+	}
+	return keys, nil
+}
+
+// KV is a key/value pair.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// SetMany sets all the given key/value pairs in a single ordered bulk write, so later pairs win
+// over earlier ones for the same key.
+func (db *MongoDB) SetMany(pairs []KV) error {
+	return db.setMany(pairs, false)
+}
+
+// SetSyncMany is like SetMany, but the bulk write uses the synchronous write concern (majority by
+// default), so all pairs are durably acknowledged before it returns.
+func (db *MongoDB) SetSyncMany(pairs []KV) error {
+	return db.setMany(pairs, true)
+}
+
+func (db *MongoDB) setMany(pairs []KV, sync bool) error {
+	models := make([]mongo.WriteModel, 0, len(pairs))
+	mutations := make([]mutation, 0, len(pairs))
+	for _, pair := range pairs {
+		if len(pair.Key) == 0 {
+			return errKeyEmpty
+		}
+		if err := db.validateKey(pair.Key); err != nil {
+			return err
+		}
+		if pair.Value == nil {
+			return errValueNil
+		}
+		update, err := db.valueUpdate(context.Background(), pair.Key, pair.Value, time.Time{})
+		if err != nil {
+			return err
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetUpsert(true).
+			SetFilter(db.keyFilter(pair.Key)).
+			SetUpdate(update))
+		mutations = append(mutations, mutation{pair.Key, pair.Value})
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	present, err := db.keysPresent(context.Background(), mutations)
+	if err != nil {
+		return err
+	}
+
+	collection := db.collection
+	if sync || db.config.DefaultSync {
+		collection = db.syncCollection
+	}
+
+	opts := options.BulkWrite().SetOrdered(true)
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+	if _, err := db.bulkWrite(context.Background(), collection, models, opts); err != nil {
+		return err
+	}
+	return db.auditMany(context.Background(), mutations, present)
+}
+
+// defaultBulkWriteChunkSize is the default of MongoConfig.BulkWriteChunkSize.
+const defaultBulkWriteChunkSize = 1000
+
+// bulkWrite applies models to collection in order, in consecutive bulk writes of at most
+// MongoConfig.BulkWriteChunkSize models, and returns the counts of all of them. Each bulk write is
+// retried on its own, unless ctx is the context of a transaction: a failure then aborts the
+// transaction, which is retried as a whole.
+func (db *MongoDB) bulkWrite(ctx context.Context, collection MongoCollection, models []mongo.WriteModel,
+	opts *options.BulkWriteOptions) (_ BatchResult, err error) {
+	defer db.observe("bulk_write", time.Now(), &err)
+	size := db.config.BulkWriteChunkSize
+	if size <= 0 {
+		size = defaultBulkWriteChunkSize
+	}
+	inTxn := mongo.SessionFromContext(ctx) != nil
+	var total BatchResult
+	err = forEachChunk(len(models), size, func(lo, hi int) error {
+		var result *mongo.BulkWriteResult
+		write := func() (err error) {
+			ctx, cancel := db.consistentContext(ctx)
+			defer cancel()
+			result, err = collection.BulkWrite(ctx, models[lo:hi], opts)
+			return err
+		}
+		var err error
+		if inTxn {
+			err = write()
+		} else {
+			err = db.retry(write)
+		}
+		if err != nil {
+			return bulkWriteError(models[lo:hi], lo, err)
+		}
+		total.add(result)
+		return nil
+	})
+	return total, err
+}
+
+// bulkWriteError wraps err, returned by the bulk write of models, the first of which has the given
+// index among all operations written, with the index, kind and key of the operation the server
+// rejected. The driver error is wrapped, so that errors.Is and errors.As still see its codes.
+func bulkWriteError(models []mongo.WriteModel, offset int, err error) error {
+	var exception mongo.BulkWriteException
+	if !errors.As(err, &exception) || len(exception.WriteErrors) == 0 {
+		return err
+	}
+	index := exception.WriteErrors[0].Index
+	if index < 0 || index >= len(models) {
+		return err
+	}
+	var op string
+	var filter interface{}
+	switch model := models[index].(type) {
+	case *mongo.UpdateOneModel:
+		op, filter = "set", model.Filter
+	case *mongo.DeleteOneModel:
+		op, filter = "delete", model.Filter
+	default:
+		return fmt.Errorf("bulk write operation %d: %w", offset+index, err)
+	}
+	var key []byte
+	if filter, ok := filter.(bson.M); ok {
+		if key, ok = filter["key"].([]byte); !ok {
+			key, _ = filter["_id"].([]byte)
+		}
+	}
+	return fmt.Errorf("bulk write operation %d, %s of key %X: %w", offset+index, op, key, err)
+}
+
+// forEachChunk calls fn with the bounds [lo, hi) of consecutive chunks of at most size of the
+// indexes [0, n), in order, stopping at the first error.
+func forEachChunk(n, size int, fn func(lo, hi int) error) error {
+	for lo := 0; lo < n; lo += size {
+		hi := lo + size
+		if hi > n {
+			hi = n
+		}
+		if err := fn(lo, hi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *MongoDB) delete(key []byte, sync bool) (err error) {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	sync = sync || db.config.DefaultSync
+	if err := db.validateKey(key); err != nil {
+		return err
+	}
+	defer db.observe("delete", time.Now(), &err)
+
+	collection := db.collection
+	if sync {
+		collection = db.syncCollection
+	} else {
+		release, err := db.acquireWrite(context.Background())
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	opts := options.Delete()
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+	var result *mongo.DeleteResult
+	err = db.retry(func() (err error) {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		result, err = collection.DeleteOne(ctx, db.keyFilter(key), opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return db.audit(context.Background(), mutation{key: key}, result.DeletedCount > 0)
+}
+
+// DeleteMany deletes all the given keys in a single round trip. Keys which do not exist are
+// ignored.
+func (db *MongoDB) DeleteMany(keys [][]byte) error {
+	_, err := db.DeleteManyCount(keys)
+	return err
+}
+
+// DeleteManyCount is like DeleteMany, but also returns the number of keys which were deleted.
+func (db *MongoDB) DeleteManyCount(keys [][]byte) (int64, error) {
+	for _, key := range keys {
+		if len(key) == 0 {
+			return 0, errKeyEmpty
+		}
+		if err := db.validateKey(key); err != nil {
+			return 0, err
+		}
+	}
+	return db.deleteKeys(keys)
+}
+
+// deleteKeys deletes keys in a single round trip and audits their deletion, without validating
+// them, and returns the number of keys which were deleted.
+func (db *MongoDB) deleteKeys(keys [][]byte) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	mutations := make([]mutation, 0, len(keys))
+	for _, key := range keys {
+		mutations = append(mutations, mutation{key: key})
+	}
+	present, err := db.keysPresent(context.Background(), mutations)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := options.Delete()
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+	var deleted int64
+	err = db.retry(func() error {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		result, err := db.collection.DeleteMany(ctx, db.keysFilter(keys), opts)
+		if err != nil {
+			return err
+		}
+		deleted = result.DeletedCount
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, db.auditMany(context.Background(), mutations, present)
+}
+
+// DeleteRange deletes all keys in the domain [start, end) in a single round trip, with a nil start
+// or end leaving that side of the domain open, as for Iterator.
+//
+// With an audit log, the keys of the domain are queried first in order to audit their deletion,
+// so keys set concurrently between the query and the deletion may be deleted without an entry.
+func (db *MongoDB) DeleteRange(start, end []byte) error {
+	filter, err := rangeFilter(start, end)
+	if err != nil {
+		return err
+	}
+
+	var mutations []mutation
+	if db.auditCollection != nil {
+		if mutations, err = db.rangeDeletions(filter); err != nil {
+			return err
+		}
+	}
+
+	opts := options.Delete()
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+	err = db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		_, err := db.collection.DeleteMany(ctx, filter, opts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]bool, len(mutations))
+	for _, m := range mutations {
+		present[string(m.key)] = true
+	}
+	return db.auditMany(context.Background(), mutations, present)
+}
+
+// defaultDeleteRangeBatchSize is the default batch size of DeleteRangeBatched.
+const defaultDeleteRangeBatchSize = 1000
+
+// DeleteRangeBatched is like DeleteRange, but deletes the keys of the domain in ascending order,
+// batchSize keys at a time, so that pruning a large domain does not run as a single long
+// deletion holding up other operations and timing out. After each batch, progress, if not nil, is
+// called with the number of keys deleted so far. A batchSize of zero or less deletes 1000 keys at
+// a time.
+//
+// The domain is not deleted atomically: if DeleteRangeBatched fails, the batches deleted before
+// the failure stay deleted, and it can be called again to resume. Keys set in the domain
+// concurrently may or may not be deleted.
+func (db *MongoDB) DeleteRangeBatched(start, end []byte, batchSize int, progress func(deleted int)) error {
+	if _, err := rangeFilter(start, end); err != nil {
+		return err
+	}
+	if batchSize <= 0 {
+		batchSize = defaultDeleteRangeBatchSize
+	}
+
+	deleted := 0
+	for {
+		keys, err := db.rangeKeys(start, end, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		n, err := db.deleteKeys(keys)
+		if err != nil {
+			return err
+		}
+		deleted += int(n)
+		if progress != nil {
+			progress(deleted)
+		}
+		if len(keys) < batchSize {
+			return nil
+		}
+		// The next batch starts right after the last key of this one.
+		last := keys[len(keys)-1]
+		start = append(last[:len(last):len(last)], 0)
+	}
+}
+
+// rangeKeys returns the first limit keys of the domain [start, end), in ascending order.
+func (db *MongoDB) rangeKeys(start, end []byte, limit int) ([][]byte, error) {
+	filter, err := rangeFilter(start, end)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().
+		SetSort(iteratorSort(1)).
+		SetLimit(int64(limit)).
+		SetProjection(bson.M{"_id": 0, "key": 1})
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+
+	var keys [][]byte
+	err = db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		cursor, err := db.collection.Find(ctx, filter, opts)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		keys = keys[:0]
+		for cursor.Next(ctx) {
+			var doc map[string][]byte
+			if err := cursor.Decode(&doc); err != nil {
+				return err
+			}
+			keys = append(keys, doc["key"])
+		}
+		return cursor.Err()
+	})
+	return keys, err
+}
+
+// rangeDeletions returns the deletions of the keys matching filter, for the audit log.
+func (db *MongoDB) rangeDeletions(filter bson.M) ([]mutation, error) {
+	ctx, cancel := db.opContext(context.Background())
+	defer cancel()
+	cursor, err := db.collection.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 0, "key": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var mutations []mutation
+	for cursor.Next(ctx) {
+		var doc map[string][]byte
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		mutations = append(mutations, mutation{key: doc["key"]})
+	}
+	return mutations, cursor.Err()
+}
+
+// validateKey returns errKeyTooLong if key is longer than maxKeySize, or else the error of the
+// configured KeyValidator for key, if any.
+func (db *MongoDB) validateKey(key []byte) error {
+	if len(key) > maxKeySize {
+		return errKeyTooLong
+	}
+	if db.config.KeyValidator == nil {
+		return nil
+	}
+	return db.config.KeyValidator(key)
+}
+
+// keyFilter returns the query filter selecting the document of key.
+func (db *MongoDB) keyFilter(key []byte) bson.M {
+	if db.config.KeyAsID {
+		return bson.M{"_id": key}
+	}
+	return bson.M{"key": key}
+}
+
+// keysFilter returns the query filter selecting the documents of keys.
+func (db *MongoDB) keysFilter(keys [][]byte) bson.M {
+	if db.config.KeyAsID {
+		return bson.M{"_id": bson.M{"$in": keys}}
+	}
+	return bson.M{"key": bson.M{"$in": keys}}
+}
+
+// comment returns the comment to attach to the next operation, or "" if there is none.
+func (db *MongoDB) comment() string {
+	if db.config.Comment == nil {
+		return ""
+	}
+	return db.config.Comment()
+}
+
+// closeTimeout bounds how long Close waits for in-use connections to be returned to the pool
+// before closing them.
+const closeTimeout = 10 * time.Second
+
+// Close implements DB, after which operations fail with ErrClosed. It disconnects the client,
+// unless the database does not own it: the client of a MongoDBFactory, shared by the databases it
+// opens, and the client given to NewMongoDBWithClient, which belongs to the caller, are left
+// connected. Closing the database again does nothing.
+//
+// Close is safe to call concurrently with other operations: those not started yet fail with
+// ErrClosed, and those in progress are waited for, for up to 10 seconds, before the client is
+// disconnected. An operation still in progress after that fails with ErrClosed.
+func (db *MongoDB) Close() error {
+	if !db.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	db.active.drain(closeTimeout)
+
+	var err error
+	if db.config.PurgeOnClose {
+		err = db.purgeExpired()
+	}
+	if db.ownsClient {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		if disconnectErr := db.client.Disconnect(ctx); err == nil {
+			err = disconnectErr
+		}
+	}
+	return err
+}
+
+// activeOps counts the operations in progress on a MongoDB, so that Close can wait for them.
+type activeOps struct {
+	mtx      sync.Mutex
+	count    int
+	draining bool
+	idle     chan struct{} // Closed once the last operation ends while draining
+}
+
+// begin records the start of an operation, or returns ErrClosed once the operations are drained.
+// Every successful call must be matched by a call to end.
+func (a *activeOps) begin() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.draining {
+		return ErrClosed
+	}
+	a.count++
+	return nil
+}
+
+// end records the end of an operation started by begin.
+func (a *activeOps) end() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.count--
+	if a.count == 0 && a.idle != nil {
+		close(a.idle)
+		a.idle = nil
+	}
+}
+
+// drain rejects the operations started from now on, and waits for those in progress to end, for
+// up to timeout. It reports whether they all ended.
+func (a *activeOps) drain(timeout time.Duration) bool {
+	a.mtx.Lock()
+	a.draining = true
+	if a.count == 0 {
+		a.mtx.Unlock()
+		return true
+	}
+	if a.idle == nil {
+		a.idle = make(chan struct{})
+	}
+	idle := a.idle
+	a.mtx.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// checkOpen returns ErrClosed if the database has been closed.
+func (db *MongoDB) checkOpen() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	return nil
+}
+
+// purgeExpired deletes the keys which have expired but have not been removed by the server's TTL
+// monitor yet. It is called by Close, once operations are rejected, so it is not retried.
+func (db *MongoDB) purgeExpired() error {
+	ctx, cancel := db.opContext(context.Background())
+	defer cancel()
+	_, err := db.syncCollection.DeleteMany(ctx, bson.M{"expireAt": bson.M{"$lte": time.Now()}})
+	return err
+}
+
+// Print implements DB. The keys are streamed from an iterator, so the collection is never held
+// in memory.
+func (db *MongoDB) Print() error {
+	return db.fprint(os.Stdout)
+}
+
+// fprint prints all key/value pairs to w in ascending key order, like Print.
+func (db *MongoDB) fprint(w io.Writer) error {
+	itr, err := db.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		if _, err := fmt.Fprintf(w, "[%X]:\t[%X]\n", itr.Key(), itr.Value()); err != nil {
+			return err
+		}
+	}
+	return itr.Error()
+}
+
+// Ping checks that the server is reachable, by pinging a server selected with the configured read
+// preference, and returns an error if it cannot be reached before ctx is done or the operation
+// timeout elapses. It is cheaper than a dummy read, and suitable for liveness probes.
+func (db *MongoDB) Ping(ctx context.Context) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if err := db.checkClient(); err != nil {
+		return err
+	}
+	readPref, err := db.config.readPreference()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := db.opContext(ctx)
+	defer cancel()
+	return db.client.Ping(ctx, readPref)
+}
+
+// RefreshTopology waits until the driver has selected a primary, probing the deployment as
+// needed. This is useful right after a planned failover or maintenance event to rediscover the
+// topology proactively instead of waiting for the next heartbeat.
+//
+// The driver does not expose topology refreshes directly, so this pings the primary: when no
+// primary is known to be selectable, server selection makes the driver check every server
+// immediately and keeps doing so until a primary is found or ctx expires.
+func (db *MongoDB) RefreshTopology(ctx context.Context) error {
+	if err := db.checkClient(); err != nil {
+		return err
+	}
+	return db.retry(func() error {
+		ctx, cancel := db.opContext(ctx)
+		defer cancel()
+		return db.client.Ping(ctx, readpref.Primary())
+	})
+}
+
+// Sync waits until all writes acknowledged so far, including asynchronous ones, are durable as
+// required for synchronous writes: journaled, and acknowledged as configured by
+// MongoConfig.WriteConcern. It lets most writes be asynchronous while guaranteeing durability at
+// commit boundaries.
+//
+// The journal is written in order, so Sync issues a single journaled write, touching the metadata
+// document of the collection, rather than the fsync command: it therefore needs no privilege
+// beyond writing to the collection, and works on all deployments, including those where fsync is
+// not permitted, such as Atlas. Replication is in order as well, so on a replica set the writes
+// acknowledged before Sync were replicated as required once it returns. Writes still in flight
+// when Sync is called may or may not be covered.
+func (db *MongoDB) Sync() error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	collection, err := withWriteConcern(db.syncCollection, journaled(db.config.WriteConcern))
+	if err != nil {
+		return err
+	}
+	return db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": metaID}, bson.M{"$currentDate": bson.M{"syncedAt": true}})
+		return err
+	})
+}
+
+// journaled returns the write concern wc, or the default acknowledgment if it is nil, also
+// requiring the write to be journaled.
+func journaled(wc *writeconcern.WriteConcern) *writeconcern.WriteConcern {
+	journal := true
+	if wc == nil {
+		return &writeconcern.WriteConcern{Journal: &journal}
+	}
+	copied := *wc
+	copied.Journal = &journal
+	return &copied
+}
+
+// Count returns the number of keys in the database, leaving out its metadata document.
+func (db *MongoDB) Count() (int64, error) {
+	return db.CountRange(nil, nil)
+}
+
+// CountRange returns the number of keys in the domain [start, end), with a nil start or end
+// leaving that side of the domain open, as for Iterator. The keys are counted on the server with
+// the key index, without being returned, so the cost grows with the number of keys in the domain
+// but is far below that of iterating over them. Like iterators, it counts keys which have expired
+// but have not been removed by the server's TTL monitor yet.
+func (db *MongoDB) CountRange(start, end []byte) (_ int64, err error) {
+	filter, err := rangeFilter(start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer db.observe("count", time.Now(), &err)
+	opts := options.Count()
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+
+	var count int64
+	err = db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		n, err := db.readCollection.CountDocuments(ctx, filter, opts)
+		count = n
+		return err
+	})
+	return count, err
+}
+
+// RangeSize returns the number of bytes occupied by the documents whose keys fall in the domain
+// [start, end), as reported by $bsonSize. A nil start or end leaves that side of the domain open.
+//
+// The size is computed by an aggregation that visits every document in the range on the server,
+// so its cost grows linearly with the number of keys in the range; avoid calling it on hot paths.
+// Index and storage engine overhead are not included.
+func (db *MongoDB) RangeSize(start, end []byte) (int64, error) {
+	filter, err := rangeFilter(start, end)
+	if err != nil {
+		return 0, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.M{
+			"_id":  nil,
+			"size": bson.M{"$sum": bson.M{"$bsonSize": "$$ROOT"}},
+		}}},
+	}
+	var result struct {
+		Size int64 `bson:"size"`
+	}
+	err = db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		cursor, err := db.readCollection.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		if !cursor.Next(ctx) {
+			// No documents in the range.
+			result.Size = 0
+			return cursor.Err()
+		}
+		return cursor.Decode(&result)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.Size, nil
+}
+
+// CountByPrefixes returns the number of keys starting with each of prefixes, keyed by the hex
+// encoding of the prefix. An empty prefix counts all keys.
+//
+// The counts are computed in a single aggregation, which matches the keys under any of the
+// prefixes using the key index and then counts them per prefix, so its cost grows linearly with
+// the total number of keys under the prefixes, with keys under overlapping prefixes visited once
+// and counted towards each of them.
+func (db *MongoDB) CountByPrefixes(prefixes [][]byte) (map[string]int64, error) {
+	counts := make(map[string]int64, len(prefixes))
+	if len(prefixes) == 0 {
+		return counts, nil
+	}
+
+	ranges := make(bson.A, 0, len(prefixes))
+	facets := bson.M{}
+	for i, prefix := range prefixes {
+		var start, end []byte
+		if len(prefix) > 0 {
+			start, end = prefix, prefixEnd(prefix)
+		}
+		filter, err := rangeFilter(start, end)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, filter)
+		facets[fmt.Sprintf("p%d", i)] = bson.A{
+			bson.M{"$match": filter},
+			bson.M{"$count": "n"},
+		}
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"$or": ranges}}},
+		{{Key: "$facet", Value: facets}},
+	}
+	var result map[string][]struct {
+		N int64 `bson:"n"`
+	}
+	err := db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		cursor, err := db.readCollection.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		result = nil
+		if !cursor.Next(ctx) {
+			return cursor.Err()
+		}
+		return cursor.Decode(&result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, prefix := range prefixes {
+		var n int64
+		// A facet matching no keys has no count document.
+		if facet := result[fmt.Sprintf("p%d", i)]; len(facet) > 0 {
+			n = facet[0].N
+		}
+		counts[hex.EncodeToString(prefix)] = n
+	}
+	return counts, nil
+}
+
+// RangeDigest returns a SHA-256 digest of the key/value pairs in the domain [start, end), in key
+// order, streamed through an iterator. A nil start or end leaves that side of the domain open.
+// The digest only depends on the pairs, not on how they are stored, so it can be compared with
+// one computed by another store; see digestIterator for the exact encoding.
+func (db *MongoDB) RangeDigest(start, end []byte) ([]byte, error) {
+	itr, err := db.Iterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+	return digestIterator(itr)
+}
+
+// digestIterator hashes the remaining pairs of itr with SHA-256. Each pair is encoded as the
+// uvarint length of the key, the key, the uvarint length of the value and the value, which keeps
+// the encoding of a sequence of pairs unambiguous.
+func digestIterator(itr Iterator) ([]byte, error) {
+	hash := sha256.New()
+	var length [binary.MaxVarintLen64]byte
+	for ; itr.Valid(); itr.Next() {
+		key, value := itr.Key(), itr.Value()
+		hash.Write(length[:binary.PutUvarint(length[:], uint64(len(key)))])
+		hash.Write(key)
+		hash.Write(length[:binary.PutUvarint(length[:], uint64(len(value)))])
+		hash.Write(value)
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// ErrNotSharded is returned by ShardDistribution when not connected to a sharded cluster.
+var ErrNotSharded = errors.New("mongodb deployment is not a sharded cluster")
+
+// ShardDistribution returns the number of documents of the collection stored on each shard,
+// keyed by shard name, for instance to check how evenly keys are balanced. The counts come from
+// the collection metadata of each shard, as reported by $collStats, so they are cheap to obtain
+// but may be approximate, and they include the collection's metadata document. A collection
+// which is not sharded is reported entirely on its primary shard. ErrNotSharded is returned if
+// the deployment is not a sharded cluster.
+func (db *MongoDB) ShardDistribution() (map[string]int64, error) {
+	pipeline := mongo.Pipeline{{{Key: "$collStats", Value: bson.M{"count": bson.M{}}}}}
+	var distribution map[string]int64
+	err := db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		cursor, err := db.collection.Aggregate(ctx, pipeline)
+		if err != nil {
+			return err
+		}
+		defer cursor.Close(ctx)
+
+		distribution = map[string]int64{}
+		for cursor.Next(ctx) {
+			var stats struct {
+				Shard string `bson:"shard"`
+				Count int64  `bson:"count"`
+			}
+			if err := cursor.Decode(&stats); err != nil {
+				return err
+			}
+			if stats.Shard == "" {
+				// Only mongos reports which shard the statistics come from.
+				return ErrNotSharded
+			}
+			distribution[stats.Shard] += stats.Count
+		}
+		return cursor.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return distribution, nil
+}
+
+// clientOptions returns the options of the client connecting to uri.
+func (cfg MongoConfig) clientOptions(uri string) *options.ClientOptions {
+	opts := options.Client().ApplyURI(uri)
+	if cfg.MaxConnIdleTime != 0 {
+		opts.SetMaxConnIdleTime(cfg.MaxConnIdleTime)
+	}
+	if cfg.MaxConnecting != 0 {
+		opts.SetMaxConnecting(cfg.MaxConnecting)
+	}
+	if cfg.MaxPoolSize != 0 {
+		opts.SetMaxPoolSize(cfg.MaxPoolSize)
+	}
+	if cfg.MinPoolSize != 0 {
+		opts.SetMinPoolSize(cfg.MinPoolSize)
+	}
+	if cfg.CommandMonitor != nil {
+		opts.SetMonitor(cfg.CommandMonitor)
+	}
+	if cfg.TLSConfig != nil {
+		opts.SetTLSConfig(cfg.TLSConfig)
+	}
+	return opts
+}
+
+// readCollectionOptions returns the options of the collection serving point reads.
+func (cfg MongoConfig) readCollectionOptions(readPref *readpref.ReadPref) *options.CollectionOptions {
+	opts := options.Collection()
+	if readPref != nil {
+		opts.SetReadPreference(readPref)
+	}
+	if cfg.ReadConcern != nil {
+		opts.SetReadConcern(cfg.ReadConcern)
+	}
+	return opts
+}
+
+// iteratorCollectionOptions returns the options of the collection serving iterators.
+func (cfg MongoConfig) iteratorCollectionOptions(readPref *readpref.ReadPref) *options.CollectionOptions {
+	opts := cfg.readCollectionOptions(readPref)
+	if cfg.IteratorReadConcern != nil {
+		opts.SetReadConcern(cfg.IteratorReadConcern)
+	}
+	return opts
+}
+
+// isStandalone reports whether client is connected to a standalone server, rather than to a
+// replica set or a sharded cluster.
+func isStandalone(ctx context.Context, client *mongo.Client) (bool, error) {
+	var hello bson.M
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := hello["setName"]; ok {
+		return false, nil
+	}
+	return hello["msg"] != "isdbgrid", nil
+}
+
+// minMaxStaleness is the smallest max staleness allowed by the server selection specification.
+const minMaxStaleness = 90 * time.Second
+
+// readPreference builds the read preference configured by cfg, or returns nil if the one from the
+// URI should be used.
+func (cfg MongoConfig) readPreference() (*readpref.ReadPref, error) {
+	if cfg.ReadPreference == 0 {
+		if cfg.MaxStaleness != 0 {
+			return nil, errors.New("max staleness requires a read preference other than primary")
+		}
+		return nil, nil
+	}
+
+	var opts []readpref.Option
+	if cfg.MaxStaleness != 0 {
+		if cfg.MaxStaleness < minMaxStaleness {
+			return nil, fmt.Errorf("max staleness must be at least %v, got %v", minMaxStaleness, cfg.MaxStaleness)
+		}
+		opts = append(opts, readpref.WithMaxStaleness(cfg.MaxStaleness))
+	}
+	return readpref.New(cfg.ReadPreference, opts...)
+}
+
+// defaultOperationTimeout is the default of MongoConfig.OperationTimeout.
+const defaultOperationTimeout = 30 * time.Second
+
+// operationContext returns the context of a single call to the server, derived from ctx and
+// bounded by timeout as described on MongoConfig.OperationTimeout.
+func operationContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || timeout < 0 {
+		return ctx, func() {}
+	}
+	if timeout == 0 {
+		timeout = defaultOperationTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// opContext returns the context of a single call to the server, derived from ctx.
+func (db *MongoDB) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return operationContext(ctx, db.config.OperationTimeout)
+}
+
+// retry runs op, and runs it again for as long as the configured retry policy considers the
+// returned error retryable. If a circuit breaker is configured, op is not run while it is open,
+// and the final outcome of op is reported to it. Like track, retry does not run op once the
+// database is closed.
+func (db *MongoDB) retry(op func() error) error {
+	return db.track(func() error {
+		if db.breaker == nil {
+			return db.attempt(op)
+		}
+		if err := db.breaker.allow(); err != nil {
+			return err
+		}
+		err := db.attempt(op)
+		db.breaker.done(err)
+		return err
+	})
+}
+
+// track runs op once, unless the database is closed, and makes Close wait for it to return before
+// disconnecting the client. It is meant for operations which cannot be retried on their own, such
+// as those of transactions.
+func (db *MongoDB) track(op func() error) (err error) {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if err := db.active.begin(); err != nil {
+		return err
+	}
+	defer db.active.end()
+	defer func() { err = db.closedError(err) }()
+	return op()
+}
+
+// closedError returns ErrClosed if err is the failure of an operation whose client Close
+// disconnected, having given up waiting for it, and err otherwise.
+func (db *MongoDB) closedError(err error) error {
+	if errors.Is(err, mongo.ErrClientDisconnected) && db.closed.Load() {
+		return ErrClosed
+	}
+	return err
+}
+
+// attempt runs op until it succeeds or the retry policy gives up, backing off exponentially
+// between attempts.
+func (db *MongoDB) attempt(op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !db.shouldRetry(err, attempt) {
+			return err
+		}
+		time.Sleep(db.config.retryDelay(attempt))
+	}
+}
+
+// shouldRetry reports whether an operation that failed with err after the given number of
+// attempts should be retried.
+func (db *MongoDB) shouldRetry(err error, attempt int) bool {
+	if db.config.ShouldRetry != nil {
+		return db.config.ShouldRetry(err, attempt)
+	}
+	return attempt <= db.config.retryAttempts() && IsTransient(err)
+}
+
+const (
+	// defaultRetryAttempts is the default of MongoConfig.RetryAttempts.
+	defaultRetryAttempts = 3
+	// defaultRetryBaseDelay is the default of MongoConfig.RetryBaseDelay.
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	// maxRetryDelay bounds the delay before a retry.
+	maxRetryDelay = 5 * time.Second
+)
+
+// retryAttempts returns the number of retries of MongoConfig.RetryAttempts.
+func (cfg MongoConfig) retryAttempts() int {
+	switch {
+	case cfg.RetryAttempts == 0:
+		return defaultRetryAttempts
+	case cfg.RetryAttempts < 0:
+		return 0
+	}
+	return cfg.RetryAttempts
+}
+
+// retryDelay returns how long to wait before retrying an operation which failed after the given
+// number of attempts.
+func (cfg MongoConfig) retryDelay(attempt int) time.Duration {
+	delay := cfg.RetryBaseDelay
+	if delay <= 0 {
+		delay = defaultRetryBaseDelay
+	}
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// IsTransient reports whether err is a transient MongoDB error, such as a network error, a
+// timeout or a primary step-down, which may succeed if the operation is retried.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var labeled mongo.LabeledError
+	if errors.As(err, &labeled) {
+		return labeled.HasErrorLabel("RetryableWriteError") || labeled.HasErrorLabel("TransientTransactionError")
+	}
+	return false
+}
+
+// prepareCollection records the layout of collection and creates its indexes, if not done yet.
+func prepareCollection(collection, syncCollection *mongo.Collection, cfg MongoConfig) error {
+	// Check the layout first, so that no index of another layout is created.
+	err := checkLayout(context.Background(), syncCollection, cfg.layout())
+	if err != nil {
+		return err
+	}
+
+	var indexes []mongo.IndexModel
+	if !cfg.KeyAsID {
+		indexes = append(indexes, mongo.IndexModel{Keys: bson.D{{Key: "key", Value: 1}}})
+	}
+	// Iterators sort by keyHex, breaking ties by _id; see iteratorSort. The index also serves the
+	// range filters on keyHex.
+	indexes = append(indexes, mongo.IndexModel{Keys: bson.D{{Key: "keyHex", Value: 1}, {Key: "_id", Value: 1}}})
+	if cfg.SecondaryIndex != nil {
+		indexes = append(indexes, mongo.IndexModel{Keys: bson.D{{Key: "secondary", Value: 1}}})
+	}
+	// Lets the server remove keys once past their expireAt.
+	indexes = append(indexes, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return ensureIndexes(context.Background(), collection, indexes, cfg)
+}
+
+// existingIndex is an index of a collection, as listed by the server.
+type existingIndex struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	ExpireAfterSeconds *int32 `bson:"expireAfterSeconds"`
+}
+
+// ensureIndexes creates those of indexes, each with keys given as a bson.D, which are not covered
+// by an existing index of collection. Creation is skipped for covered indexes rather than left to
+// the server, which would accept identical indexes as a no-op, so that opening a collection whose
+// indexes exist needs no privilege to create them. With cfg.BestEffortIndexes, failures to list or
+// create the indexes are logged rather than returned.
+func ensureIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel,
+	cfg MongoConfig) error {
+	var existing []existingIndex
+	cursor, err := collection.Indexes().List(ctx)
+	if err == nil {
+		err = cursor.All(ctx, &existing)
+	}
+	if err != nil {
+		if !cfg.BestEffortIndexes {
+			return err
+		}
+		cfg.Logger.Error("Unable to list the indexes of the collection, creating them all",
+			"collection", collection.Name(), "err", err)
+	}
+
+	for _, index := range indexes {
+		if indexCovered(existing, index) {
+			continue
+		}
+		if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+			if !cfg.BestEffortIndexes {
+				return err
+			}
+			cfg.Logger.Error("Unable to create index, continuing without it",
+				"collection", collection.Name(), "index", fmt.Sprint(index.Keys), "err", err)
+		}
+	}
+	return nil
+}
+
+// indexCovered reports whether one of existing serves the queries of index: one whose keys start
+// with those of index, in the same order and directions, such as a compound index of which index
+// is a prefix. A TTL index is only covered by an index with the same keys and expiry.
+func indexCovered(existing []existingIndex, index mongo.IndexModel) bool {
+	keys := index.Keys.(bson.D)
+	var expireAfterSeconds *int32
+	if index.Options != nil {
+		expireAfterSeconds = index.Options.ExpireAfterSeconds
+	}
+
+	for _, e := range existing {
+		if len(e.Key) < len(keys) {
+			continue
+		}
+		if expireAfterSeconds != nil && (len(e.Key) != len(keys) || e.ExpireAfterSeconds == nil ||
+			*e.ExpireAfterSeconds != *expireAfterSeconds) {
+			continue
+		}
+		covered := true
+		for i, key := range keys {
+			if e.Key[i].Key != key.Key || !sameIndexDirection(e.Key[i].Value, key.Value) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+// sameIndexDirection reports whether two index key directions are equal, whatever numeric type
+// the server listed them with.
+func sameIndexDirection(a, b interface{}) bool {
+	toFloat := func(v interface{}) (float64, bool) {
+		switch v := v.(type) {
+		case int:
+			return float64(v), true
+		case int32:
+			return float64(v), true
+		case int64:
+			return float64(v), true
+		case float64:
+			return v, true
+		}
+		return 0, false
+	}
+	x, okA := toFloat(a)
+	y, okB := toFloat(b)
+	if !okA || !okB {
+		// Special index types, such as "text" or "2dsphere".
+		return a == b
+	}
+	return x == y
+}
+
+// sensitiveURIOptions are the lowercased names of the connection string options which may hold
+// credentials, such as the AWS session token of authMechanismProperties.
+var sensitiveURIOptions = map[string]bool{
+	"authmechanismproperties":         true,
+	"tlscertificatekeyfilepassword":   true,
+	"sslclientcertificatekeypassword": true,
+	"password":                        true,
+	"token":                           true,
+}
+
+// SanitizeMongoURI removes the username and password from a MongoDB URI, and redacts the values of
+// the query options which may hold credentials. The error returned for a malformed URI does not
+// quote any part of it, so that it is safe to log as well.
+func SanitizeMongoURI(originalURI string) (string, error) {
+	// Parse the original URI
+	u, err := url.Parse(originalURI)
+	if err != nil {
+		// The parse error quotes the URI, or the part of it which failed to parse, which may be the
+		// password.
+		return "", errors.New("malformed uri")
+	}
+
+	if u.Scheme != "mongodb" && u.Scheme != "mongodb+srv" {
+		return "", errors.New("invalid scheme")
+	}
+
+	// Remove username and password
+	u.User = nil
+
+	// Reconstruct the URI
+	sanitizedURI := fmt.Sprintf(
+		"%s://%s%s",
+		u.Scheme,
+		u.Host,
 		u.Path,
 	)
 
 	// If there are any query parameters, add them back
 	if u.RawQuery != "" {
-		sanitizedURI = fmt.Sprintf("%s?%s", sanitizedURI, u.RawQuery)
+		sanitizedURI = fmt.Sprintf("%s?%s", sanitizedURI, sanitizeURIQuery(u.RawQuery))
 	}
 
 	return sanitizedURI, nil
 }
+
+// sanitizeURIQuery redacts the values of the sensitive options of the raw query of a URI, keeping
+// the options in order. An option whose name cannot be unescaped is redacted as well.
+func sanitizeURIQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		unescaped, err := url.QueryUnescape(name)
+		if err != nil || sensitiveURIOptions[strings.ToLower(unescaped)] {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// auditEntry is a document of the audit log configured by MongoConfig.AuditLog, recording a
+// single mutation.
+type auditEntry struct {
+	Key []byte `bson:"key"`
+	// Op is "set" or "delete".
+	Op string `bson:"op"`
+	// OldValuePresent is whether the key had a value before the mutation.
+	OldValuePresent bool `bson:"oldValuePresent"`
+	// NewValueHash is the SHA-256 hash of the value set, or nil for deletes.
+	NewValueHash []byte    `bson:"newValueHash,omitempty"`
+	Timestamp    time.Time `bson:"timestamp"`
+}
+
+// mutation is a write of value to key, or a deletion of key if value is nil.
+type mutation struct {
+	key   []byte
+	value []byte
+}
+
+func newAuditEntry(m mutation, oldValuePresent bool, now time.Time) auditEntry {
+	entry := auditEntry{
+		Key:             m.key,
+		Op:              "delete",
+		OldValuePresent: oldValuePresent,
+		Timestamp:       now,
+	}
+	if m.value != nil {
+		hash := sha256.Sum256(m.value)
+		entry.Op = "set"
+		entry.NewValueHash = hash[:]
+	}
+	return entry
+}
+
+// audit appends an entry for the mutation m to the audit log, if one is configured. Within a
+// transaction, ctx must be its session context, so that the entry is committed with it.
+func (db *MongoDB) audit(ctx context.Context, m mutation, oldValuePresent bool) error {
+	if db.auditCollection == nil {
+		return nil
+	}
+	ctx, cancel := db.opContext(ctx)
+	defer cancel()
+	_, err := db.auditCollection.InsertOne(ctx, newAuditEntry(m, oldValuePresent, time.Now().UTC()))
+	return err
+}
+
+// auditMany is like audit for a sequence of mutations applied in order. present holds the keys
+// which had a value before the first mutation, as returned by keysPresent, and is updated in
+// place.
+func (db *MongoDB) auditMany(ctx context.Context, mutations []mutation, present map[string]bool) error {
+	if db.auditCollection == nil || len(mutations) == 0 {
+		return nil
+	}
+
+	ctx, cancel := db.opContext(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	entries := make([]interface{}, 0, len(mutations))
+	for _, m := range mutations {
+		entries = append(entries, newAuditEntry(m, present[string(m.key)], now))
+		present[string(m.key)] = m.value != nil
+	}
+	_, err := db.auditCollection.InsertMany(ctx, entries, options.InsertMany().SetOrdered(true))
+	return err
+}
+
+// keysPresent returns which of the keys mutated by mutations currently have a value, for
+// auditMany. It returns nil without querying the server if no audit log is configured.
+func (db *MongoDB) keysPresent(ctx context.Context, mutations []mutation) (map[string]bool, error) {
+	if db.auditCollection == nil || len(mutations) == 0 {
+		return nil, nil
+	}
+
+	ctx, cancel := db.opContext(ctx)
+	defer cancel()
+
+	keys := make([][]byte, 0, len(mutations))
+	for _, m := range mutations {
+		keys = append(keys, m.key)
+	}
+	cursor, err := db.collection.Find(ctx, db.keysFilter(keys),
+		options.Find().SetProjection(bson.M{"_id": 0, "key": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	present := make(map[string]bool, len(keys))
+	for cursor.Next(ctx) {
+		var doc map[string][]byte
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		present[string(doc["key"])] = true
+	}
+	return present, cursor.Err()
+}
+
+// auditCollectionFor returns the collection of the audit log configured by cfg in database, or
+// nil if there is none. Entries are written with the synchronous write concern.
+func auditCollectionFor(database *mongo.Database, cfg MongoConfig) *mongo.Collection {
+	if cfg.AuditLog == "" {
+		return nil
+	}
+	return database.Collection(cfg.AuditLog, options.Collection().SetWriteConcern(cfg.WriteConcern))
+}
@@ -0,0 +1,307 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// backupMagic starts every backup archive, followed by the format version.
+const (
+	backupMagic   = "CMTDBBAK"
+	backupVersion = 1
+)
+
+// restoreBatchSize is the number of pairs RestoreFrom writes per bulk write.
+const restoreBatchSize = 1000
+
+// restoreBatchBytes bounds the total size of the pairs RestoreFrom holds in memory for a bulk
+// write, which is written early once it is reached, so that archives of large values are not
+// restored restoreBatchSize values at a time.
+const restoreBatchBytes = 64 << 20
+
+// maxBackupFieldSize bounds the length of a key or value read from an archive. Values too large
+// for a BSON document are stored in GridFS, so it is far above the 16MB document limit.
+const maxBackupFieldSize = 1 << 30
+
+// backupFieldChunk is the size above which fields are read from an archive in chunks, growing
+// the buffer as data arrives, so that a corrupt length in a truncated archive cannot trigger a
+// huge allocation upfront.
+const backupFieldChunk = 1 << 20
+
+// ErrCorruptBackup is returned by RestoreFrom for archives which are malformed, truncated or fail
+// their checksum.
+var ErrCorruptBackup = errors.New("corrupt backup archive")
+
+// Backup streams all key/value pairs of the collection to w as a gzip-compressed archive, which
+// RestoreFrom reads back.
+//
+// The uncompressed archive holds the magic "CMTDBBAK" and a version byte, the number of pairs as
+// a uvarint, every pair in ascending key order as a uvarint-length-prefixed key followed by a
+// uvarint-length-prefixed value, and finally the SHA-256 checksum of everything before it.
+//
+// The pairs are counted before they are streamed, and Backup fails if the collection is written
+// to in between, so it is meant for stores which are not being written to.
+func (db *MongoDB) Backup(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	if err := db.Export(gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Export is like Backup, but writes the archive uncompressed, for callers which compress or
+// encrypt it themselves, or feed it to other tools. Import reads it back.
+func (db *MongoDB) Export(w io.Writer) error {
+	filter, err := rangeFilter(nil, nil)
+	if err != nil {
+		return err
+	}
+	// The pairs are counted with the read preference and read concern of iterators, so that the
+	// count and the iteration see the same data.
+	var count int64
+	err = db.retry(func() error {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		n, err := db.iterCollection.CountDocuments(ctx, filter)
+		count = n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	itr, err := db.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	return writeBackup(w, uint64(count), itr)
+}
+
+// writeBackup writes the uncompressed archive of the count pairs of itr to w.
+func writeBackup(w io.Writer, count uint64, itr Iterator) error {
+	checksum := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	if _, err := buf.WriteString(backupMagic); err != nil {
+		return err
+	}
+	if err := buf.WriteByte(backupVersion); err != nil {
+		return err
+	}
+	if err := writeUvarint(buf, count); err != nil {
+		return err
+	}
+
+	var written uint64
+	for ; itr.Valid(); itr.Next() {
+		if written == count {
+			return fmt.Errorf("more than the %d pairs counted were found, the DB was written to during the backup",
+				count)
+		}
+		for _, field := range [][]byte{itr.Key(), itr.Value()} {
+			if err := writeUvarint(buf, uint64(len(field))); err != nil {
+				return err
+			}
+			if _, err := buf.Write(field); err != nil {
+				return err
+			}
+		}
+		written++
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+	if written != count {
+		return fmt.Errorf("%d pairs were counted but %d found, the DB was written to during the backup",
+			count, written)
+	}
+
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(checksum.Sum(nil))
+	return err
+}
+
+func writeUvarint(w *bufio.Writer, x uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.Write(buf[:binary.PutUvarint(buf[:], x)])
+	return err
+}
+
+// RestoreFrom loads an archive written by Backup into the collection, which must be empty. Pairs
+// are written in bulk writes of up to restoreBatchSize pairs with the synchronous write concern.
+//
+// The archive is streamed rather than held in memory, so its checksum can only be verified once
+// all pairs are written. If RestoreFrom returns an error, including ErrCorruptBackup, the
+// collection may hold part of the archive, and should be dropped before trying again.
+func (db *MongoDB) RestoreFrom(r io.Reader) error {
+	filter, err := rangeFilter(nil, nil)
+	if err != nil {
+		return err
+	}
+	var count int64
+	err = db.retry(func() (err error) {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		count, err = db.syncCollection.CountDocuments(ctx, filter)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		return fmt.Errorf("cannot restore into collection %s, which holds %d keys", db.collectionName, count)
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCorruptBackup, err)
+	}
+	defer gz.Close()
+
+	return readBackup(gz, func(pairs []KV) error {
+		return db.SetSyncMany(pairs)
+	})
+}
+
+// Import loads an uncompressed archive written by Export into the collection, in bulk writes of
+// up to restoreBatchSize pairs with the synchronous write concern. Unlike RestoreFrom, it does not
+// require the collection to be empty: the keys of the archive overwrite existing ones, and the
+// other keys are kept. As for RestoreFrom, the checksum is only verified once all pairs are
+// written, so the collection may hold part of the archive if Import returns an error.
+func (db *MongoDB) Import(r io.Reader) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	return readBackup(r, db.SetSyncMany)
+}
+
+// readBackup reads the uncompressed archive from r, passing its pairs to write in batches of up
+// to restoreBatchSize pairs.
+func readBackup(r io.Reader, write func(pairs []KV) error) error {
+	buf := bufio.NewReader(r)
+	hr := &hashingReader{r: buf, hash: sha256.New()}
+
+	header := make([]byte, len(backupMagic)+1)
+	if _, err := io.ReadFull(hr, header); err != nil {
+		return corruptBackup(err)
+	}
+	if string(header[:len(backupMagic)]) != backupMagic {
+		return fmt.Errorf("%w: not a backup archive", ErrCorruptBackup)
+	}
+	if version := header[len(backupMagic)]; version != backupVersion {
+		return fmt.Errorf("unsupported backup archive version %d", version)
+	}
+	count, err := binary.ReadUvarint(hr)
+	if err != nil {
+		return corruptBackup(err)
+	}
+
+	pairs := make([]KV, 0, restoreBatchSize)
+	size := 0
+	for i := uint64(0); i < count; i++ {
+		key, err := readBackupField(hr)
+		if err != nil {
+			return err
+		}
+		value, err := readBackupField(hr)
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, KV{Key: key, Value: value})
+		size += len(key) + len(value)
+		if len(pairs) == restoreBatchSize || size >= restoreBatchBytes {
+			if err := write(pairs); err != nil {
+				return err
+			}
+			pairs = make([]KV, 0, restoreBatchSize)
+			size = 0
+		}
+	}
+	if len(pairs) != 0 {
+		if err := write(pairs); err != nil {
+			return err
+		}
+	}
+
+	checksum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(buf, checksum); err != nil {
+		return corruptBackup(err)
+	}
+	if !bytes.Equal(checksum, hr.hash.Sum(nil)) {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorruptBackup)
+	}
+	if _, err := buf.ReadByte(); err != io.EOF {
+		return fmt.Errorf("%w: trailing data after the checksum", ErrCorruptBackup)
+	}
+	return nil
+}
+
+func readBackupField(r *hashingReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, corruptBackup(err)
+	}
+	if n > maxBackupFieldSize {
+		return nil, fmt.Errorf("%w: field of %d bytes", ErrCorruptBackup, n)
+	}
+	if n <= backupFieldChunk {
+		field := make([]byte, n)
+		if _, err := io.ReadFull(r, field); err != nil {
+			return nil, corruptBackup(err)
+		}
+		return field, nil
+	}
+
+	var field bytes.Buffer
+	field.Grow(backupFieldChunk)
+	if _, err := io.CopyN(&field, r, int64(n)); err != nil {
+		return nil, corruptBackup(err)
+	}
+	return field.Bytes(), nil
+}
+
+// corruptBackup wraps the error err of reading an archive, reporting truncated or badly
+// compressed archives as ErrCorruptBackup.
+func corruptBackup(err error) error {
+	var flateErr flate.CorruptInputError
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: truncated", ErrCorruptBackup)
+	case errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.As(err, &flateErr):
+		return fmt.Errorf("%w: %v", ErrCorruptBackup, err)
+	}
+	return err
+}
+
+// hashingReader hashes all bytes read through it.
+type hashingReader struct {
+	r    *bufio.Reader
+	hash hash.Hash
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.hash.Write(p[:n])
+	return n, err
+}
+
+func (hr *hashingReader) ReadByte() (byte, error) {
+	b, err := hr.r.ReadByte()
+	if err == nil {
+		hr.hash.Write([]byte{b})
+	}
+	return b, err
+}
@@ -2,27 +2,63 @@ package db
 
 import (
 	"context"
-	"encoding/hex"
 	"fmt"
+	"time"
 
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 type MongoDBBatch struct {
-	collection     *mongo.Collection
-	syncCollection *mongo.Collection // For synchronous operations
+	db             *MongoDB
+	collection     MongoCollection
+	syncCollection MongoCollection // For synchronous operations
 	ops            []mongo.WriteModel
+	mutations      []mutation                 // The mutation of each of ops, for the audit log
+	copies         []batchCopy                // Copies whose destination writes are resolved at write time
+	size           int                        // Approximate size of the queued operations, as returned by Size
+	result         BatchResult                // Counts of the last write, as returned by WriteResult
+	writeConcern   *writeconcern.WriteConcern // Set by SetWriteConcern, nil for the defaults
 	closed         bool
 }
 
+// BatchResult counts the documents affected by the write of a MongoDBBatch.
+type BatchResult struct {
+	// Upserted is the number of keys set which did not exist before.
+	Upserted int64
+	// Matched is the number of keys set which already existed, including those whose value was
+	// set again unchanged.
+	Matched int64
+	// Modified is the number of existing keys whose document was changed.
+	Modified int64
+	// Deleted is the number of keys deleted, not counting deletes of missing keys.
+	Deleted int64
+}
+
+// add adds the counts of a bulk write to r.
+func (r *BatchResult) add(result *mongo.BulkWriteResult) {
+	r.Upserted += result.UpsertedCount
+	r.Matched += result.MatchedCount
+	r.Modified += result.ModifiedCount
+	r.Deleted += result.DeletedCount
+}
+
+// batchCopy is a pending Copy, whose write model goes at ops[index] once the source is resolved.
+type batchCopy struct {
+	index int
+	src   []byte
+	dst   []byte
+}
+
 var _ Batch = (*MongoDBBatch)(nil)
 
-func newMongoDBBatch(collection *mongo.Collection, syncCollection *mongo.Collection) *MongoDBBatch {
+func newMongoDBBatch(db *MongoDB) *MongoDBBatch {
 	return &MongoDBBatch{
-		collection:     collection,
-		syncCollection: syncCollection,
+		db:             db,
+		collection:     db.collection,
+		syncCollection: db.syncCollection,
 		ops:            []mongo.WriteModel{},
 		closed:         false,
 	}
@@ -33,6 +69,9 @@ func (b *MongoDBBatch) Set(key, value []byte) error {
 	if len(key) == 0 {
 		return errKeyEmpty
 	}
+	if err := b.db.validateKey(key); err != nil {
+		return err
+	}
 	if value == nil {
 		return errValueNil
 	}
@@ -41,11 +80,10 @@ func (b *MongoDBBatch) Set(key, value []byte) error {
 		return fmt.Errorf("batch has already been closed")
 	}
 
-	// b.ops = append(b.ops, mongo.NewInsertOneModel().SetDocument(bson.M{"key": key, "value": value}))
-	b.ops = append(b.ops, mongo.NewUpdateOneModel().
-		SetUpsert(true).
-		SetFilter(bson.M{"key": key}).
-		SetUpdate(bson.M{"$set": bson.M{"value": value, "keyHex": hex.EncodeToString(key)}}))
+	// Placeholder, replaced by buildSets.
+	b.ops = append(b.ops, nil)
+	b.mutations = append(b.mutations, mutation{key, value})
+	b.size += len(key) + len(value)
 	return nil
 }
 
@@ -54,12 +92,114 @@ func (b *MongoDBBatch) Delete(key []byte) error {
 	if len(key) == 0 {
 		return errKeyEmpty
 	}
+	if err := b.db.validateKey(key); err != nil {
+		return err
+	}
+
+	if b.closed {
+		return fmt.Errorf("batch has already been closed")
+	}
+
+	b.ops = append(b.ops, mongo.NewDeleteOneModel().SetFilter(b.db.keyFilter(key)))
+	b.mutations = append(b.mutations, mutation{key: key})
+	b.size += len(key)
+	return nil
+}
+
+// Copy sets dstKey to the value of srcKey.
+//
+// Bulk writes cannot read, so the source values of all copies are fetched in a single query when
+// the batch is written, before any of its operations are applied. Copies are therefore not atomic
+// with respect to their sources: a copy does not observe writes to its source made earlier in the
+// same batch, and a source changed concurrently between the read and the write is copied with its
+// previous value. Writing the batch fails without applying anything if a source does not exist.
+func (b *MongoDBBatch) Copy(srcKey, dstKey []byte) error {
+	if len(srcKey) == 0 || len(dstKey) == 0 {
+		return errKeyEmpty
+	}
+	if err := b.db.validateKey(dstKey); err != nil {
+		return err
+	}
 
 	if b.closed {
 		return fmt.Errorf("batch has already been closed")
 	}
 
-	b.ops = append(b.ops, mongo.NewDeleteOneModel().SetFilter(bson.M{"key": key}))
+	b.copies = append(b.copies, batchCopy{index: len(b.ops), src: srcKey, dst: dstKey})
+	// Placeholder, replaced by buildSets once resolveCopies has fetched the value.
+	b.ops = append(b.ops, nil)
+	b.mutations = append(b.mutations, mutation{key: dstKey})
+	b.size += len(srcKey) + len(dstKey)
+	return nil
+}
+
+// WriteResult returns the counts of the documents affected by the last successful Write, WriteSync
+// or WriteTx of the batch, summed over all of its bulk writes, or zero counts if it has not been
+// written. Unlike the operations of the batch, it is kept once the batch is closed.
+func (b *MongoDBBatch) WriteResult() BatchResult {
+	return b.result
+}
+
+// SetWriteConcern makes Write, WriteSync and WriteTx apply the operations of the batch with the
+// write concern wc, for instance to have a single batch acknowledged by more members than the
+// configured WriteConcern requires, instead of the write concern of the database for asynchronous
+// or synchronous writes. A nil wc restores these defaults. The write concern is kept by Reset.
+func (b *MongoDBBatch) SetWriteConcern(wc *writeconcern.WriteConcern) {
+	b.writeConcern = wc
+}
+
+// Size returns the approximate size in bytes of the queued operations: the length of the key and
+// value of every Set, of the key of every Delete, and of both keys of every Copy, whose value is
+// only known once the batch is written. Callers may use it to write a batch before it grows too
+// large. It is reset to zero once the batch is written or closed.
+func (b *MongoDBBatch) Size() int {
+	return b.size
+}
+
+// resolveCopies fetches the sources of all pending copies and records them as the values set by
+// their mutations. Copies are resolved again if the batch is applied again, as when a transaction
+// is retried.
+func (b *MongoDBBatch) resolveCopies(ctx context.Context) error {
+	if len(b.copies) == 0 {
+		return nil
+	}
+
+	srcKeys := make([][]byte, 0, len(b.copies))
+	for _, c := range b.copies {
+		srcKeys = append(srcKeys, c.src)
+	}
+	ctx, cancel := b.db.opContext(ctx)
+	defer cancel()
+	cursor, err := b.collection.Find(ctx, b.db.keysFilter(srcKeys),
+		options.Find().SetProjection(keyValueProjection))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	values := make(map[string][]byte, len(srcKeys))
+	for cursor.Next(ctx) {
+		var doc map[string][]byte
+		if err := cursor.Decode(&doc); err != nil {
+			return err
+		}
+		value, err := b.db.documentValue(ctx, doc)
+		if err != nil {
+			return err
+		}
+		values[string(doc["key"])] = value
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range b.copies {
+		value, ok := values[string(c.src)]
+		if !ok {
+			return fmt.Errorf("copy source %X: %w", c.src, ErrKeyNotFound)
+		}
+		b.mutations[c.index].value = value
+	}
 	return nil
 }
 
@@ -77,29 +217,170 @@ func (b *MongoDBBatch) write(sync bool) error {
 	if b.closed {
 		return fmt.Errorf("batch has already been closed")
 	}
+	if err := b.db.checkOpen(); err != nil {
+		return err
+	}
 
-	var targetCollection *mongo.Collection
-	if sync {
+	var targetCollection MongoCollection
+	switch {
+	case b.writeConcern != nil:
+		var err error
+		if targetCollection, err = withWriteConcern(b.syncCollection, b.writeConcern); err != nil {
+			return err
+		}
+	case sync || b.db.config.DefaultSync:
 		targetCollection = b.syncCollection
-	} else {
+	default:
 		targetCollection = b.collection
 	}
+	if err := b.apply(context.Background(), targetCollection); err != nil {
+		return err
+	}
+	b.closed = true
+	return b.Close()
+}
+
+// WriteTx is like WriteSync, but applies all operations of the batch in a single multi-document
+// transaction, so that either all of them are applied or, if any fails, none. The transaction is
+// retried as a whole on transient errors.
+//
+// Transactions require a replica set or a sharded cluster: on a standalone server WriteTx returns
+// ErrTransactionsUnsupported without applying anything, and the batch can still be written with
+// WriteSync. Transactions are limited by the server in duration and size, so very large batches
+// may fail with WriteTx while succeeding with WriteSync.
+func (b *MongoDBBatch) WriteTx() error {
+	if b.closed {
+		return fmt.Errorf("batch has already been closed")
+	}
+	if err := b.db.checkOpen(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err := b.db.retry(func() error {
+		ctx, cancel := b.db.opContext(ctx)
+		defer cancel()
+		return b.db.checkTransactionsSupported(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	session, err := b.db.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	wc := b.db.config.WriteConcern
+	if b.writeConcern != nil {
+		wc = b.writeConcern
+	}
+	txnOpts := options.Transaction().
+		SetWriteConcern(wc).
+		SetReadPreference(readpref.Primary())
+	// WithTransaction retries the transaction itself, so it is run once, for Close to wait for it.
+	err = b.db.track(func() error {
+		_, err := session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+			return nil, b.apply(sessCtx, b.syncCollection)
+		}, txnOpts)
+		return err
+	})
+	if err != nil {
+		// The operations applied by the aborted transaction were rolled back.
+		b.result = BatchResult{}
+		return err
+	}
+	b.closed = true
+	return b.Close()
+}
+
+// apply resolves the copies of the batch, writes its operations to collection in order and audits
+// them, within the transaction of ctx if there is one.
+func (b *MongoDBBatch) apply(ctx context.Context, collection MongoCollection) error {
+	if err := b.resolveCopies(ctx); err != nil {
+		return err
+	}
+	if err := b.buildSets(ctx); err != nil {
+		return err
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+
 	writeOptions := &options.BulkWriteOptions{}
 	writeOptions.SetOrdered(true)
+	if comment := b.db.comment(); comment != "" {
+		writeOptions.SetComment(comment)
+	}
 
-	if len(b.ops) != 0 {
-		_, err := targetCollection.BulkWrite(context.Background(), b.ops, writeOptions)
+	present, err := b.db.keysPresent(ctx, b.mutations)
+	if err != nil {
+		return err
+	}
+	result, err := b.db.bulkWrite(ctx, collection, b.ops, writeOptions)
+	if err != nil {
+		return err
+	}
+	if err := b.db.auditMany(ctx, b.mutations, present); err != nil {
+		return err
+	}
+	b.result = result
+	return nil
+}
+
+// buildSets builds the writes of the values set by the batch, including those of copies, when it
+// is applied rather than when they are queued, so that keys expiring under MongoConfig.PrefixTTLs
+// expire counting from the write, as with Set. Values too large to be stored inline are uploaded
+// to GridFS, their writes pointing at the uploaded files. Like copies, the writes are built, and
+// the values uploaded, again if the batch is applied again.
+func (b *MongoDBBatch) buildSets(ctx context.Context) error {
+	for i, m := range b.mutations {
+		if m.value == nil {
+			// A delete.
+			continue
+		}
+		update, err := b.db.valueUpdate(ctx, m.key, m.value, time.Time{})
 		if err != nil {
 			return err
 		}
+		b.ops[i] = mongo.NewUpdateOneModel().
+			SetUpsert(true).
+			SetFilter(b.db.keyFilter(m.key)).
+			SetUpdate(update)
 	}
-	b.closed = true
-	return b.Close()
+	return nil
+}
+
+// Reset clears the operations of the batch and reopens it, so that it can be reused after it has
+// been written or closed rather than allocating a new batch, as for every block of a chain. The
+// memory allocated for the operations is kept, and WriteResult returns zero counts until the batch
+// is written again.
+func (b *MongoDBBatch) Reset() {
+	b.clear()
+	b.result = BatchResult{}
+	b.closed = false
+}
+
+// clear drops the queued operations, keeping their allocated memory for Reset.
+func (b *MongoDBBatch) clear() {
+	for i := range b.ops {
+		b.ops[i] = nil
+	}
+	for i := range b.mutations {
+		b.mutations[i] = mutation{}
+	}
+	for i := range b.copies {
+		b.copies[i] = batchCopy{}
+	}
+	b.ops = b.ops[:0]
+	b.mutations = b.mutations[:0]
+	b.copies = b.copies[:0]
+	b.size = 0
 }
 
-// Close implements Batch.
+// Close implements Batch. The batch can be reused with Reset.
 func (b *MongoDBBatch) Close() error {
-	b.ops = nil
+	b.clear()
 	b.closed = true
 	return nil
 }
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting the server while the circuit breaker configured
+// by MongoConfig.BreakerThreshold is open.
+var ErrCircuitOpen = errors.New("mongodb circuit breaker is open")
+
+// defaultBreakerCooldown is the default time an open circuit breaker waits before probing.
+const defaultBreakerCooldown = 10 * time.Second
+
+// circuitBreaker short-circuits operations after a run of consecutive transient failures, as
+// classified by IsTransient, so that an unavailable server is not hammered by every caller.
+//
+// The breaker starts closed, letting operations through. Once threshold operations in a row have
+// failed it opens, failing all operations with ErrCircuitOpen. After cooldown it half-opens,
+// letting a single probe operation through: if the probe succeeds the breaker closes, and
+// otherwise it opens again for another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mtx      sync.Mutex
+	failures int       // Consecutive transient failures
+	openedAt time.Time // Zero while closed
+	probing  bool      // Whether the probe of a half-open breaker is in flight
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if cooldown == 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow returns ErrCircuitOpen if an operation must not be attempted. Otherwise, the outcome of
+// the operation must be reported with done.
+func (cb *circuitBreaker) allow() error {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if cb.openedAt.IsZero() {
+		return nil
+	}
+	if cb.probing || time.Since(cb.openedAt) < cb.cooldown {
+		return ErrCircuitOpen
+	}
+	cb.probing = true
+	return nil
+}
+
+// done records the outcome of an operation let through by allow.
+func (cb *circuitBreaker) done(err error) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+
+	if !IsTransient(err) {
+		// The server answered, even if with an error.
+		cb.failures = 0
+		cb.openedAt = time.Time{}
+		cb.probing = false
+		return
+	}
+
+	cb.failures++
+	if cb.probing || cb.failures >= cb.threshold {
+		cb.openedAt = time.Now()
+		cb.probing = false
+	}
+}
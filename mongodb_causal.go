@@ -0,0 +1,91 @@
+package db
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// causalClock holds the latest cluster and operation times observed by the causally consistent
+// sessions of a MongoDB, as configured by MongoConfig.ReadYourWrites. Sessions are not safe for
+// concurrent use, so every operation gets its own, which starts from the clock and advances it
+// once the operation is done: each operation is thereby ordered after all those which completed
+// before it started.
+type causalClock struct {
+	mtx           sync.Mutex
+	clusterTime   bson.Raw
+	operationTime *primitive.Timestamp
+}
+
+// start advances session to the times of the clock.
+func (c *causalClock) start(session mongo.Session) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.clusterTime != nil {
+		if err := session.AdvanceClusterTime(c.clusterTime); err != nil {
+			return err
+		}
+	}
+	if c.operationTime != nil {
+		if err := session.AdvanceOperationTime(c.operationTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observe advances the clock to the times of session, if they are later.
+func (c *causalClock) observe(session mongo.Session) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if clusterTime := session.ClusterTime(); clusterTime != nil &&
+		clusterTimestamp(clusterTime).After(clusterTimestamp(c.clusterTime)) {
+		c.clusterTime = clusterTime
+	}
+	if operationTime := session.OperationTime(); operationTime != nil &&
+		(c.operationTime == nil || operationTime.After(*c.operationTime)) {
+		c.operationTime = operationTime
+	}
+}
+
+// clusterTimestamp returns the timestamp of the cluster time document clusterTime, or the zero
+// timestamp if it has none.
+func clusterTimestamp(clusterTime bson.Raw) primitive.Timestamp {
+	var ts primitive.Timestamp
+	if value, err := clusterTime.LookupErr("$clusterTime", "clusterTime"); err == nil {
+		ts.T, ts.I, _ = value.TimestampOK()
+	}
+	return ts
+}
+
+// consistentContext is like opContext, but if MongoConfig.ReadYourWrites is set, the returned
+// context also carries a causally consistent session started from the clock of the database,
+// which the cancel function ends after recording its times. ctx keeps its own session, as within
+// a transaction, and the session is left out without a client.
+//
+// The session is ended with the call, so consistentContext must not be used for cursors read past
+// it, such as those of iterators.
+func (db *MongoDB) consistentContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := db.opContext(ctx)
+	if db.clock == nil || db.client == nil || mongo.SessionFromContext(ctx) != nil {
+		return ctx, cancel
+	}
+	session, err := db.client.StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		db.config.Logger.Error("Unable to start a causally consistent session, continuing without it",
+			"err", err)
+		return ctx, cancel
+	}
+	if err := db.clock.start(session); err != nil {
+		db.config.Logger.Error("Unable to advance a causally consistent session", "err", err)
+	}
+	return mongo.NewSessionContext(ctx, session), func() {
+		db.clock.observe(session)
+		session.EndSession(context.Background())
+		cancel()
+	}
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// MongoCollection is the subset of the methods of *mongo.Collection used to read and write the
+// keys of a MongoDB. It lets a MongoDB be backed by an in-memory fake in unit tests, with
+// NewMongoDBWithCollection, rather than by a mongod server.
+type MongoCollection interface {
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) *mongo.SingleResult
+	FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+	UpdateOne(ctx context.Context, filter interface{}, update interface{},
+		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	BulkWrite(ctx context.Context, models []mongo.WriteModel,
+		opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+}
+
+var _ MongoCollection = (*mongo.Collection)(nil)
+
+// errNoClient is returned by the operations which need a client, such as transactions, by a
+// MongoDB opened with NewMongoDBWithCollection.
+var errNoClient = errors.New("mongodb database has no client, as it was opened with NewMongoDBWithCollection")
+
+// NewMongoDBWithCollection opens a database storing its keys in collection, which is used for all
+// reads and writes, whatever the read preference and write concerns of cfg. It is mainly meant for
+// unit tests against an in-memory fake of the collection.
+//
+// The collection is used as is: its indexes are not created and its layout is not checked. There
+// is no client, so the options of cfg about the connection and the audit log are ignored, and the
+// operations which need a client, such as transactions, Ping, Compact and values too large to be
+// stored inline, fail. cfg.ReadYourWrites, which needs the sessions of a client, is rejected.
+// cfg.Collection only names the collection in log messages and statistics.
+func NewMongoDBWithCollection(collection MongoCollection, cfg MongoConfig) (DB, error) {
+	if _, err := cfg.readPreference(); err != nil {
+		return nil, err
+	}
+	if cfg.ReadYourWrites {
+		return nil, fmt.Errorf("ReadYourWrites: %w", errNoClient)
+	}
+	cfg.setDefaults()
+
+	db := &MongoDB{
+		collectionName: cfg.Collection,
+		collection:     collection,
+		syncCollection: collection,
+		readCollection: collection,
+		iterCollection: collection,
+		config:         cfg,
+	}
+	if cfg.BreakerThreshold > 0 {
+		db.breaker = newCircuitBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+	}
+	if cfg.MaxInflightWrites > 0 {
+		db.inflight = newInflightLimiter(cfg.MaxInflightWrites, cfg.RejectInflightWrites)
+	}
+	return db, nil
+}
+
+// checkClient returns errNoClient if the database has no client.
+func (db *MongoDB) checkClient() error {
+	if db.client == nil {
+		return errNoClient
+	}
+	return nil
+}
+
+// withWriteConcern returns a copy of collection using the write concern wc. A collection other than
+// a *mongo.Collection, such as a fake, has no write concern, and is returned as is.
+func withWriteConcern(collection MongoCollection, wc *writeconcern.WriteConcern) (MongoCollection, error) {
+	c, ok := collection.(*mongo.Collection)
+	if !ok {
+		return collection, nil
+	}
+	return c.Clone(options.Collection().SetWriteConcern(wc))
+}
@@ -0,0 +1,739 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeMongoDBBackend opens MongoDB databases backed by a fakeCollection, so that the shared backend
+// suite runs against the MongoDB code paths without a mongod server.
+const fakeMongoDBBackend BackendType = "fakemongodb"
+
+func init() {
+	registerDBCreator(fakeMongoDBBackend, func(name, dir string) (DB, error) {
+		return NewMongoDBWithCollection(newFakeCollection(), MongoConfig{Collection: name})
+	}, false)
+}
+
+// errFakeUnsupported is returned by fakeCollection for queries and updates it does not implement.
+var errFakeUnsupported = errors.New("not supported by the fake collection")
+
+// fakeCollection is an in-memory MongoCollection. It supports the filters, updates, sorts and
+// projections MongoDB issues for its keys with the default layout: equality, $exists, $in, $or,
+// $and and comparisons of binary, string, integer and date fields in filters, and $set, $unset,
+// $setOnInsert, $inc and $currentDate in updates. Documents have no _id.
+type fakeCollection struct {
+	mtx  sync.Mutex
+	docs []bson.M
+}
+
+var _ MongoCollection = (*fakeCollection)(nil)
+
+func newFakeCollection() *fakeCollection {
+	return &fakeCollection{}
+}
+
+func (c *fakeCollection) Find(_ context.Context, filter interface{},
+	opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	o := options.MergeFindOptions(opts...)
+	docs, err := c.find(filter, o.Sort, o.Projection)
+	if err != nil {
+		return nil, err
+	}
+	if o.Limit != nil && *o.Limit > 0 && int(*o.Limit) < len(docs) {
+		docs = docs[:*o.Limit]
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (c *fakeCollection) FindOne(_ context.Context, filter interface{},
+	opts ...*options.FindOneOptions) *mongo.SingleResult {
+	o := options.MergeFindOneOptions(opts...)
+	docs, err := c.find(filter, o.Sort, o.Projection)
+	if err == nil && len(docs) == 0 {
+		err = mongo.ErrNoDocuments
+	}
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.M{}, err, nil)
+	}
+	return mongo.NewSingleResultFromDocument(docs[0], nil, nil)
+}
+
+func (c *fakeCollection) FindOneAndUpdate(_ context.Context, filter interface{}, update interface{},
+	opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndUpdateOptions(opts...)
+	if o.Upsert != nil && *o.Upsert {
+		return mongo.NewSingleResultFromDocument(bson.M{}, fmt.Errorf("upsert: %w", errFakeUnsupported), nil)
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, doc := range c.docs {
+		ok, err := fakeMatches(doc, filter)
+		if err != nil {
+			return mongo.NewSingleResultFromDocument(bson.M{}, err, nil)
+		}
+		if !ok {
+			continue
+		}
+		before, _ := fakeProject(doc, nil)
+		if err := fakeApply(doc, update, false); err != nil {
+			return mongo.NewSingleResultFromDocument(bson.M{}, err, nil)
+		}
+		if o.ReturnDocument == nil || *o.ReturnDocument == options.Before {
+			doc = before
+		}
+		projected, err := fakeProject(doc, o.Projection)
+		return mongo.NewSingleResultFromDocument(projected, err, nil)
+	}
+	return mongo.NewSingleResultFromDocument(bson.M{}, mongo.ErrNoDocuments, nil)
+}
+
+func (c *fakeCollection) UpdateOne(_ context.Context, filter interface{}, update interface{},
+	opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	o := options.MergeUpdateOptions(opts...)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.updateOne(filter, update, o.Upsert != nil && *o.Upsert)
+}
+
+func (c *fakeCollection) DeleteOne(_ context.Context, filter interface{},
+	_ ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.delete(filter, 1)
+}
+
+func (c *fakeCollection) DeleteMany(_ context.Context, filter interface{},
+	_ ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.delete(filter, -1)
+}
+
+func (c *fakeCollection) BulkWrite(_ context.Context, models []mongo.WriteModel,
+	_ ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// Writes are always ordered, stopping at the first failure.
+	result := &mongo.BulkWriteResult{}
+	for _, model := range models {
+		switch model := model.(type) {
+		case *mongo.UpdateOneModel:
+			updated, err := c.updateOne(model.Filter, model.Update, model.Upsert != nil && *model.Upsert)
+			if err != nil {
+				return result, err
+			}
+			result.MatchedCount += updated.MatchedCount
+			result.ModifiedCount += updated.ModifiedCount
+			result.UpsertedCount += updated.UpsertedCount
+		case *mongo.DeleteOneModel:
+			deleted, err := c.delete(model.Filter, 1)
+			if err != nil {
+				return result, err
+			}
+			result.DeletedCount += deleted.DeletedCount
+		default:
+			return result, fmt.Errorf("write model %T: %w", model, errFakeUnsupported)
+		}
+	}
+	return result, nil
+}
+
+func (c *fakeCollection) Aggregate(context.Context, interface{}, ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	return nil, errFakeUnsupported
+}
+
+func (c *fakeCollection) CountDocuments(_ context.Context, filter interface{},
+	_ ...*options.CountOptions) (int64, error) {
+	docs, err := c.find(filter, nil, nil)
+	return int64(len(docs)), err
+}
+
+// find returns the projections of the documents matching filter, in the order of sortSpec.
+func (c *fakeCollection) find(filter, sortSpec, projection interface{}) ([]interface{}, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var matching []bson.M
+	for _, doc := range c.docs {
+		ok, err := fakeMatches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matching = append(matching, doc)
+		}
+	}
+
+	if sortSpec != nil {
+		spec, ok := sortSpec.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("sort %T: %w", sortSpec, errFakeUnsupported)
+		}
+		sort.SliceStable(matching, func(i, j int) bool {
+			for _, field := range spec {
+				cmp := fakeCompare(matching[i][field.Key], matching[j][field.Key])
+				if cmp != 0 {
+					return (cmp < 0) == (field.Value == 1)
+				}
+			}
+			return false
+		})
+	}
+
+	docs := make([]interface{}, 0, len(matching))
+	for _, doc := range matching {
+		projected, err := fakeProject(doc, projection)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, projected)
+	}
+	return docs, nil
+}
+
+func (c *fakeCollection) updateOne(filter, update interface{}, upsert bool) (*mongo.UpdateResult, error) {
+	for _, doc := range c.docs {
+		ok, err := fakeMatches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if err := fakeApply(doc, update, false); err != nil {
+				return nil, err
+			}
+			return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+		}
+	}
+	if !upsert {
+		return &mongo.UpdateResult{}, nil
+	}
+
+	// Like the server, an upsert starts from the equality conditions of the filter.
+	doc := bson.M{}
+	for field, cond := range filter.(bson.M) {
+		if _, isOperator := cond.(bson.M); !isOperator && !strings.HasPrefix(field, "$") {
+			doc[field] = cond
+		}
+	}
+	if err := fakeApply(doc, update, true); err != nil {
+		return nil, err
+	}
+	c.docs = append(c.docs, doc)
+	return &mongo.UpdateResult{UpsertedCount: 1}, nil
+}
+
+// delete deletes up to limit documents matching filter, or all of them if limit is negative.
+func (c *fakeCollection) delete(filter interface{}, limit int) (*mongo.DeleteResult, error) {
+	kept := c.docs[:0]
+	var deleted int64
+	for _, doc := range c.docs {
+		ok, err := fakeMatches(doc, filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok && (limit < 0 || deleted < int64(limit)) {
+			deleted++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	c.docs = kept
+	return &mongo.DeleteResult{DeletedCount: deleted}, nil
+}
+
+// fakeMatches reports whether doc matches the query filter.
+func fakeMatches(doc bson.M, filter interface{}) (bool, error) {
+	conds, ok := filter.(bson.M)
+	if !ok {
+		return false, fmt.Errorf("filter %T: %w", filter, errFakeUnsupported)
+	}
+	for field, cond := range conds {
+		var ok bool
+		var err error
+		switch field {
+		case "$or", "$and":
+			ok, err = fakeMatchesAll(doc, cond, field == "$and")
+		default:
+			ok, err = fakeMatchesField(doc, field, cond)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// fakeMatchesAll reports whether doc matches all of the filters of clauses, or any if not all.
+func fakeMatchesAll(doc bson.M, clauses interface{}, all bool) (bool, error) {
+	filters, ok := clauses.(bson.A)
+	if !ok {
+		return false, fmt.Errorf("clauses %T: %w", clauses, errFakeUnsupported)
+	}
+	for _, filter := range filters {
+		ok, err := fakeMatches(doc, filter)
+		if err != nil {
+			return false, err
+		}
+		if ok != all {
+			return ok, nil
+		}
+	}
+	return all, nil
+}
+
+// fakeMatchesField reports whether the field of doc matches cond, a value it must be equal to or
+// a document of operators.
+func fakeMatchesField(doc bson.M, field string, cond interface{}) (bool, error) {
+	value, present := doc[field]
+	ops, ok := cond.(bson.M)
+	if !ok {
+		return present && fakeCompare(value, cond) == 0, nil
+	}
+	for op, operand := range ops {
+		var ok bool
+		switch op {
+		case "$exists":
+			ok = present == operand.(bool)
+		case "$gt":
+			ok = present && fakeCompare(value, operand) > 0
+		case "$gte":
+			ok = present && fakeCompare(value, operand) >= 0
+		case "$lt":
+			ok = present && fakeCompare(value, operand) < 0
+		case "$lte":
+			ok = present && fakeCompare(value, operand) <= 0
+		case "$in":
+			keys, isKeys := operand.([][]byte)
+			if !isKeys {
+				return false, fmt.Errorf("$in of %T: %w", operand, errFakeUnsupported)
+			}
+			for _, key := range keys {
+				ok = ok || (present && fakeCompare(value, key) == 0)
+			}
+		default:
+			return false, fmt.Errorf("query operator %s: %w", op, errFakeUnsupported)
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// fakeCompare compares two values of the same type, ordering missing values first. Values of
+// different types compare as unequal.
+func fakeCompare(a, b interface{}) int {
+	switch a := a.(type) {
+	case nil:
+		if b == nil {
+			return 0
+		}
+		return -1
+	case []byte:
+		if b, ok := b.([]byte); ok {
+			return bytes.Compare(a, b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case int64:
+		if b, ok := b.(int64); ok {
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			default:
+				return 0
+			}
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			switch {
+			case a.Before(b):
+				return -1
+			case a.After(b):
+				return 1
+			default:
+				return 0
+			}
+		}
+	}
+	if b == nil {
+		return 1
+	}
+	return -1
+}
+
+// fakeApply applies update to doc, which is being inserted by an upsert if insert is set.
+func fakeApply(doc bson.M, update interface{}, insert bool) error {
+	ops, ok := update.(bson.M)
+	if !ok {
+		return fmt.Errorf("update %T: %w", update, errFakeUnsupported)
+	}
+	for op, fields := range ops {
+		for field, value := range fields.(bson.M) {
+			switch op {
+			case "$set":
+				doc[field] = fakeCopy(value)
+			case "$setOnInsert":
+				if insert {
+					doc[field] = fakeCopy(value)
+				}
+			case "$unset":
+				delete(doc, field)
+			case "$inc":
+				n, _ := doc[field].(int64)
+				doc[field] = n + value.(int64)
+			case "$currentDate":
+				doc[field] = time.Now()
+			default:
+				return fmt.Errorf("update operator %s: %w", op, errFakeUnsupported)
+			}
+		}
+	}
+	return nil
+}
+
+// fakeCopy copies byte slices, which the caller may modify once written, as it could with a
+// server.
+func fakeCopy(value interface{}) interface{} {
+	if b, ok := value.([]byte); ok {
+		return append([]byte{}, b...)
+	}
+	return value
+}
+
+// fakeProject returns the fields of doc included by projection, or all of them if it is nil.
+func fakeProject(doc bson.M, projection interface{}) (bson.M, error) {
+	projected := bson.M{}
+	if projection == nil {
+		for field, value := range doc {
+			projected[field] = value
+		}
+		return projected, nil
+	}
+	fields, ok := projection.(bson.M)
+	if !ok {
+		return nil, fmt.Errorf("projection %T: %w", projection, errFakeUnsupported)
+	}
+	for field, include := range fields {
+		if value, present := doc[field]; present && include == 1 {
+			projected[field] = value
+		}
+	}
+	return projected, nil
+}
+
+func TestFakeMongoDBBackendGetSetDelete(t *testing.T) {
+	testBackendGetSetDelete(t, fakeMongoDBBackend)
+}
+
+func TestFakeMongoDBIterator(t *testing.T) {
+	testDBIterator(t, fakeMongoDBBackend)
+}
+
+func TestFakeMongoDBBatch(t *testing.T) {
+	testDBBatch(t, fakeMongoDBBackend)
+}
+
+func TestMongoDBWithCollection(t *testing.T) {
+	db, err := NewMongoDBWithCollection(newFakeCollection(), MongoConfig{Collection: "fake"})
+	require.NoError(t, err)
+	defer db.Close()
+	mdb := db.(*MongoDB)
+	require.Equal(t, "fake", mdb.CollectionName())
+
+	require.NoError(t, db.Set([]byte("a"), []byte("1")))
+	require.NoError(t, db.SetSync([]byte("b"), []byte{}))
+	require.NoError(t, mdb.SetWithTTL([]byte("expired"), []byte("3"), time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	checkValue(t, db, []byte("a"), []byte("1"))
+	value, err := db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.NotNil(t, value)
+	require.Empty(t, value)
+	checkValue(t, db, []byte("expired"), nil)
+	require.NoError(t, mdb.Sync())
+
+	values, err := mdb.MultiGet([][]byte{[]byte("b"), []byte("missing"), []byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{}, nil, []byte("1")}, values)
+
+	batch := mdb.NewBatch().(*MongoDBBatch)
+	require.NoError(t, batch.Set([]byte("c"), []byte("3")))
+	require.NoError(t, batch.Copy([]byte("a"), []byte("d")))
+	require.NoError(t, batch.Delete([]byte("b")))
+	require.NoError(t, batch.Write())
+	require.Equal(t, BatchResult{Upserted: 2, Deleted: 1}, batch.WriteResult())
+	checkValue(t, db, []byte("d"), []byte("1"))
+	checkValue(t, db, []byte("b"), nil)
+
+	itr, err := db.ReverseIterator([]byte("a"), []byte("d"))
+	require.NoError(t, err)
+	var keys []string
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	require.NoError(t, itr.Error())
+	require.NoError(t, itr.Close())
+	require.Equal(t, []string{"c", "a"}, keys)
+
+	// Transactions, among other operations, need a client.
+	_, err = mdb.Begin()
+	require.ErrorIs(t, err, errNoClient)
+	batch = mdb.NewBatch().(*MongoDBBatch)
+	require.NoError(t, batch.Set([]byte("e"), []byte("5")))
+	require.ErrorIs(t, batch.WriteTx(), errNoClient)
+	require.ErrorIs(t, mdb.Ping(context.Background()), errNoClient)
+	require.ErrorIs(t, mdb.Compact(context.Background()), errNoClient)
+	require.NotContains(t, mdb.Stats(), "mongodb.sessions.in_progress")
+	_, err = NewMongoDBWithCollection(newFakeCollection(), MongoConfig{ReadYourWrites: true})
+	require.ErrorIs(t, err, errNoClient)
+}
+
+// lostReplyCollection is a fakeCollection which applies the next FindOneAndUpdate, but fails it
+// with a transient error as if its reply had been lost.
+type lostReplyCollection struct {
+	*fakeCollection
+	lose atomic.Bool
+}
+
+func (c *lostReplyCollection) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{},
+	opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	result := c.fakeCollection.FindOneAndUpdate(ctx, filter, update, opts...)
+	if c.lose.CompareAndSwap(true, false) && result.Err() == nil {
+		return mongo.NewSingleResultFromDocument(bson.M{}, context.DeadlineExceeded, nil)
+	}
+	return result
+}
+
+func TestMongoDBIncrementLostReply(t *testing.T) {
+	collection := &lostReplyCollection{fakeCollection: newFakeCollection()}
+	db, err := NewMongoDBWithCollection(collection, MongoConfig{RetryBaseDelay: time.Millisecond})
+	require.NoError(t, err)
+	defer db.Close()
+	mdb := db.(*MongoDB)
+
+	n, err := mdb.Increment([]byte("counter"), 5)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+
+	// The increment was applied before its reply was lost, so it must not be applied again.
+	collection.lose.Store(true)
+	_, err = mdb.Increment([]byte("counter"), 3)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	n, err = mdb.Increment([]byte("counter"), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(8), n)
+	checkValue(t, db, []byte("counter"), []byte{0, 0, 0, 0, 0, 0, 0, 8})
+}
+
+func TestMongoDBStartCounterWritesValue(t *testing.T) {
+	db, err := NewMongoDBWithCollection(newFakeCollection(), MongoConfig{})
+	require.NoError(t, err)
+	defer db.Close()
+	mdb := db.(*MongoDB)
+	require.NoError(t, db.Set([]byte("seeded"), []byte{0, 0, 0, 0, 0, 0, 0, 7}))
+
+	// Without the write of Increment which follows an $inc, started counters already have a value.
+	var counter int64
+	started, _, err := mdb.startCounter([]byte("new"), 5, &counter)
+	require.NoError(t, err)
+	require.True(t, started)
+	require.Equal(t, int64(5), counter)
+	started, _, err = mdb.startCounter([]byte("seeded"), 1, &counter)
+	require.NoError(t, err)
+	require.True(t, started)
+	require.Equal(t, int64(8), counter)
+
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	var values [][]byte
+	for ; itr.Valid(); itr.Next() {
+		values = append(values, itr.Value())
+	}
+	require.NoError(t, itr.Error())
+	require.Equal(t, [][]byte{{0, 0, 0, 0, 0, 0, 0, 5}, {0, 0, 0, 0, 0, 0, 0, 8}}, values)
+
+	n, err := mdb.Increment([]byte("new"), 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), n)
+	checkValue(t, db, []byte("new"), []byte{0, 0, 0, 0, 0, 0, 0, 6})
+}
+
+func TestMongoDBBatchPrefixTTLFromWrite(t *testing.T) {
+	db, err := NewMongoDBWithCollection(newFakeCollection(), MongoConfig{
+		PrefixTTLs: map[string]time.Duration{"tmp/": 100 * time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Set([]byte("src"), []byte("copied")))
+
+	// The keys expire counting from the write of the batch, not from when they were queued.
+	batch := db.NewBatch().(*MongoDBBatch)
+	require.NoError(t, batch.Set([]byte("tmp/a"), []byte("value")))
+	require.NoError(t, batch.Copy([]byte("src"), []byte("tmp/b")))
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, batch.Write())
+	checkValue(t, db, []byte("tmp/a"), []byte("value"))
+	checkValue(t, db, []byte("tmp/b"), []byte("copied"))
+
+	time.Sleep(150 * time.Millisecond)
+	checkValue(t, db, []byte("tmp/a"), nil)
+	checkValue(t, db, []byte("tmp/b"), nil)
+}
+
+func TestMongoDBCloseConcurrent(t *testing.T) {
+	db, err := NewMongoDBWithCollection(newFakeCollection(), MongoConfig{})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", i, j))
+				if err := db.Set(key, []byte("value")); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := db.Get(key); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	time.Sleep(time.Millisecond)
+	require.NoError(t, db.Close())
+	wg.Wait()
+	close(errs)
+
+	// Operations racing Close either complete or fail cleanly.
+	for err := range errs {
+		require.ErrorIs(t, err, ErrClosed)
+	}
+	_, err = db.Get([]byte("key-0-0"))
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestMongoDBCloseWaitsForOperations(t *testing.T) {
+	db, err := NewMongoDBWithCollection(newFakeCollection(), MongoConfig{})
+	require.NoError(t, err)
+	mdb := db.(*MongoDB)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- mdb.retry(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	closed := make(chan error, 1)
+	go func() { closed <- db.Close() }()
+	select {
+	case <-closed:
+		t.Fatal("Close returned with an operation in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Operations started while Close waits are rejected.
+	require.ErrorIs(t, db.Set([]byte("key"), []byte("value")), ErrClosed)
+
+	close(release)
+	require.NoError(t, <-done)
+	require.NoError(t, <-closed)
+}
+
+// rejectingCollection is a fakeCollection whose bulk writes fail with a duplicate key error on the
+// operation of key, without applying anything.
+type rejectingCollection struct {
+	*fakeCollection
+	key []byte
+}
+
+func (c rejectingCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel,
+	opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	for i, model := range models {
+		var filter interface{}
+		switch model := model.(type) {
+		case *mongo.UpdateOneModel:
+			filter = model.Filter
+		case *mongo.DeleteOneModel:
+			filter = model.Filter
+		}
+		if bytes.Equal(filter.(bson.M)["key"].([]byte), c.key) {
+			return nil, mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{
+				WriteError: mongo.WriteError{Index: i, Code: 11000, Message: "E11000 duplicate key error"},
+			}}}
+		}
+	}
+	return c.fakeCollection.BulkWrite(ctx, models, opts...)
+}
+
+func TestMongoDBBulkWriteError(t *testing.T) {
+	db, err := NewMongoDBWithCollection(rejectingCollection{newFakeCollection(), []byte{0xAB, 0xCD}}, MongoConfig{})
+	require.NoError(t, err)
+	defer db.Close()
+
+	batch := db.NewBatch()
+	require.NoError(t, batch.Set([]byte{0x01}, []byte("value")))
+	require.NoError(t, batch.Delete([]byte{0xAB, 0xCD}))
+	err = batch.Write()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "bulk write operation 1, delete of key ABCD")
+	require.True(t, mongo.IsDuplicateKeyError(err))
+	var exception mongo.BulkWriteException
+	require.ErrorAs(t, err, &exception)
+
+	// The index counts the operations of all chunks.
+	mdb, err := NewMongoDBWithCollection(rejectingCollection{newFakeCollection(), []byte{0x03}},
+		MongoConfig{BulkWriteChunkSize: 2})
+	require.NoError(t, err)
+	defer mdb.Close()
+	err = mdb.(*MongoDB).SetMany([]KV{
+		{Key: []byte{0x01}, Value: []byte("1")},
+		{Key: []byte{0x02}, Value: []byte("2")},
+		{Key: []byte{0x03}, Value: []byte("3")},
+	})
+	require.ErrorContains(t, err, "bulk write operation 2, set of key 03")
+}
+
+func TestMongoDBWithCollectionLogger(t *testing.T) {
+	logger := &capturingLogger{}
+	db, err := NewMongoDBWithCollection(newFakeCollection(), MongoConfig{Collection: "fake", Logger: logger})
+	require.NoError(t, err)
+	defer db.Close()
+
+	// The fake cannot report storage statistics, which is logged rather than failing Stats.
+	stats := db.Stats()
+	require.Equal(t, "fake", stats["mongodb.collection"])
+	require.NotContains(t, stats, "mongodb.collection.count")
+	lines := logger.Lines()
+	require.Len(t, lines, 1)
+	require.Contains(t, lines[0], "Unable to read the storage statistics")
+	require.Contains(t, lines[0], "fake")
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Server error codes of commands the deployment does not let the client run.
+const (
+	unauthorizedCode        = 13
+	commandNotFoundCode     = 59
+	commandNotSupportedCode = 115
+	atlasErrorCode          = 8000 // Returned for commands disabled on Atlas shared tiers
+)
+
+// namespaceNotFoundCode is the server error code of a collection which does not exist.
+const namespaceNotFoundCode = 26
+
+// Compact reclaims the disk space freed by deleted keys, such as after heavy pruning, which the
+// server otherwise keeps allocated to the collection for reuse. It runs the compact command on
+// the collection and on the chunks of the values stored in GridFS, one after the other.
+//
+// Compaction may take long on large collections, so it is bounded by ctx only, and not by
+// MongoConfig.OperationTimeout. It blocks some operations on the collection on older servers,
+// and on a replica set only compacts the member it runs on, the primary. On deployments where
+// the command is not permitted, such as Atlas shared tiers or without the compact privilege,
+// Compact logs that it was skipped and returns nil.
+func (db *MongoDB) Compact(ctx context.Context) error {
+	if err := db.checkOpen(); err != nil {
+		return err
+	}
+	if err := db.checkClient(); err != nil {
+		return err
+	}
+
+	database := db.client.Database(db.databaseName)
+	for _, collection := range []string{db.collectionName, db.collectionName + ".values.chunks"} {
+		err := database.RunCommand(ctx, bson.D{{Key: "compact", Value: collection}}).Err()
+		switch {
+		case err == nil:
+		case isCommandError(err, namespaceNotFoundCode):
+			// No value was ever stored in GridFS.
+		case compactNotPermitted(err):
+			db.config.Logger.Info("Compaction is not permitted on this deployment, skipping it",
+				"collection", collection, "err", err)
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// compactNotPermitted reports whether err is the failure of a compact command which the deployment
+// does not let the client run.
+func compactNotPermitted(err error) bool {
+	return isCommandError(err, unauthorizedCode, commandNotFoundCode, commandNotSupportedCode, atlasErrorCode)
+}
+
+// isCommandError reports whether err is a command error with one of the given codes.
+func isCommandError(err error, codes ...int32) bool {
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	for _, code := range codes {
+		if cmdErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
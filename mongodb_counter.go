@@ -0,0 +1,206 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Increment atomically adds delta to the counter stored under key, and returns its new value. A
+// missing key counts as zero. The counter is read back by Get as its 8-byte big-endian encoding.
+//
+// The counter is kept in a numeric field which the server increments with $inc, so concurrent
+// increments never lose updates. The encoded value is written in a second step, guarded by the
+// counter so that it is never rolled back by a slower concurrent increment; until then, Get may
+// return the previous value. A counter is started along with its encoded value, so that the key
+// is never stored without one. An 8-byte value written by Set is taken as the big-endian encoding
+// of the counter to start from, while Increment fails on keys holding any other value.
+func (db *MongoDB) Increment(key []byte, delta int64) (_ int64, err error) {
+	if len(key) == 0 {
+		return 0, errKeyEmpty
+	}
+	if err := db.validateKey(key); err != nil {
+		return 0, err
+	}
+	defer db.observe("increment", time.Now(), &err)
+
+	release, err := db.acquireWrite(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	var counter int64
+	started, oldValuePresent := false, true
+	for {
+		var done bool
+		done, err = db.incrementCounter(key, delta, &counter)
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			break
+		}
+		// The key holds no counter yet: start one, unless the key changed in the meantime.
+		started, oldValuePresent, err = db.startCounter(key, delta, &counter)
+		if err != nil {
+			return 0, err
+		}
+		if started {
+			break
+		}
+	}
+
+	value := counterValue(counter)
+	if !started {
+		update := db.counterUpdate(key, counter)
+		filter := db.keyFilter(key)
+		filter["counter"] = counter
+		err = db.retry(func() error {
+			ctx, cancel := db.consistentContext(context.Background())
+			defer cancel()
+			_, err := db.collection.UpdateOne(ctx, filter, update, db.updateOptions())
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return counter, db.audit(context.Background(), mutation{key, value}, oldValuePresent)
+}
+
+// counterValue returns the value of a key holding the counter n: its 8-byte big-endian encoding.
+func counterValue(n int64) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(n))
+	return value
+}
+
+// counterUpdate builds the update document storing the counter n under key, with its encoding
+// as the value.
+func (db *MongoDB) counterUpdate(key []byte, n int64) bson.M {
+	update := db.setUpdate(key, counterValue(n), time.Time{})
+	delete(update["$unset"].(bson.M), "counter")
+	update["$set"].(bson.M)["counter"] = n
+	return update
+}
+
+// incrementCounter adds delta to the counter of key, storing its new value in counter, and
+// reports whether the key holds a counter at all.
+//
+// The $inc is not idempotent, so it is run once rather than by retry, which would apply it again
+// if only its reply were lost: retries are left to the driver's retryable writes, which the
+// server recognizes as such.
+func (db *MongoDB) incrementCounter(key []byte, delta int64, counter *int64) (bool, error) {
+	filter := db.keyFilter(key)
+	filter["counter"] = bson.M{"$exists": true}
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetProjection(bson.M{"counter": 1})
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+
+	found := false
+	err := db.track(func() error {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		var doc struct {
+			Counter int64 `bson:"counter"`
+		}
+		err := db.collection.FindOneAndUpdate(ctx, filter, bson.M{"$inc": bson.M{"counter": delta}},
+			opts).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			found = false
+			return nil
+		}
+		found, *counter = err == nil, doc.Counter
+		return err
+	})
+	return found, err
+}
+
+// startCounter starts the counter of key, which holds none, at delta plus the 8-byte value stored
+// under key if any, storing it in counter, and writes its encoding along with it. It reports
+// whether it did, which it does not if the key was written concurrently, and whether key had a
+// value. It fails if the value of key is not the encoding of a counter.
+func (db *MongoDB) startCounter(key []byte, delta int64, counter *int64) (started, oldValuePresent bool,
+	err error) {
+	findOpts := options.FindOne().SetProjection(bson.M{"value": 1, "valueRef": 1, "counter": 1})
+	if comment := db.comment(); comment != "" {
+		findOpts.SetComment(comment)
+	}
+	var doc bson.M
+	err = db.retry(func() error {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		doc = nil
+		err := db.collection.FindOne(ctx, db.keyFilter(key), findOpts).Decode(&doc)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return false, false, err
+	}
+
+	filter := db.keyFilter(key)
+	var update bson.M
+	updateOpts := db.updateOptions()
+	switch {
+	case doc == nil:
+		// Only insert, so that a document written since is not overwritten. $currentDate would
+		// also touch such a document, so the insertion is stamped by the client.
+		*counter = delta
+		fields := db.counterUpdate(key, *counter)["$set"].(bson.M)
+		fields["key"] = key
+		fields["updatedAt"] = time.Now()
+		update = bson.M{"$setOnInsert": fields}
+		updateOpts.SetUpsert(true)
+	case doc["counter"] != nil:
+		// Another Increment started the counter since.
+		return false, false, nil
+	default:
+		value, ok := doc["value"].(primitive.Binary)
+		if !ok || doc["valueRef"] != nil || len(value.Data) != 8 {
+			return false, false, fmt.Errorf("value of key %X is not a counter", key)
+		}
+		*counter = int64(binary.BigEndian.Uint64(value.Data)) + delta
+		filter["counter"] = bson.M{"$exists": false}
+		filter["value"] = value.Data
+		update = db.counterUpdate(key, *counter)
+	}
+
+	// Like the $inc of incrementCounter, starting the counter is run once: if it had been applied
+	// before a retry, the retry would report that the key changed, and the delta be added again.
+	var result *mongo.UpdateResult
+	err = db.track(func() (err error) {
+		ctx, cancel := db.consistentContext(context.Background())
+		defer cancel()
+		result, err = db.collection.UpdateOne(ctx, filter, update, updateOpts)
+		return err
+	})
+	if err != nil {
+		return false, false, err
+	}
+	if doc == nil {
+		return result.UpsertedCount > 0, false, nil
+	}
+	return result.ModifiedCount > 0, true, nil
+}
+
+// updateOptions returns the options of an update, carrying the configured comment.
+func (db *MongoDB) updateOptions() *options.UpdateOptions {
+	opts := options.Update()
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
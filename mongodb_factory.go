@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MongoDBFactory opens several databases, each storing its keys in its own collection, which
+// share a single client and thus a single connection pool. This is how a node should open its
+// stores (block store, state, transaction index, evidence), rather than with a client each.
+type MongoDBFactory struct {
+	mtx    sync.Mutex
+	client *mongo.Client
+	pool   *poolStats
+	dbName string
+	config MongoConfig
+	closed bool
+}
+
+// NewMongoDBFactory connects to the server configured by cfg. The configuration applies to every
+// database opened by the factory.
+func NewMongoDBFactory(cfg MongoConfig) (*MongoDBFactory, error) {
+	client, pool, dbName, err := connectMongo(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &MongoDBFactory{client: client, pool: pool, dbName: dbName, config: cfg}, nil
+}
+
+// Open opens the database storing its keys in the collection name, using the shared client.
+// Closing the returned database does not close the client, which is only closed by Close.
+func (f *MongoDBFactory) Open(name string) (DB, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.closed {
+		return nil, errors.New("mongodb factory has been closed")
+	}
+
+	cfg := f.config
+	cfg.Collection = ""
+	db, err := openMongoDB(f.client, f.pool, f.dbName, name, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close disconnects the shared client, after which no database opened by the factory may be
+// used anymore. Like MongoDB.Close, it waits for up to 10 seconds for in-use connections to be
+// returned to the pool before closing them. Closing the factory again does nothing.
+func (f *MongoDBFactory) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	return f.client.Disconnect(ctx)
+}
@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxInlineValueSize is the size above which values are stored in GridFS rather than inline in
+// their key document, which the server limits to 16MB. The margin leaves room for the key, its hex
+// form and the other fields of the document.
+const maxInlineValueSize = 15 * 1024 * 1024
+
+// largeValueGracePeriod is how long an unreferenced GridFS file is kept by PurgeLargeValues, so
+// that files uploaded by writes still in progress are not mistaken for orphans. It is a variable for
+// tests.
+var largeValueGracePeriod = time.Hour
+
+// valueBucket returns the GridFS bucket holding the values of the collection too large to be
+// stored inline, in the files and chunks collections "<collection>.values.files" and
+// "<collection>.values.chunks". Buckets are not safe for concurrent use, so every operation gets
+// its own; its reads and writes are bounded by the deadline of ctx, if any.
+func (db *MongoDB) valueBucket(ctx context.Context) (*gridfs.Bucket, error) {
+	if err := db.checkClient(); err != nil {
+		return nil, err
+	}
+	bucket, err := gridfs.NewBucket(db.client.Database(db.databaseName), options.GridFSBucket().
+		SetName(db.collectionName+".values").
+		SetWriteConcern(db.config.WriteConcern))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := bucket.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		if err := bucket.SetWriteDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	return bucket, nil
+}
+
+// valueUpdate is like setUpdate, but if value is too large to be stored inline it is first
+// uploaded to GridFS, and the document references the file in its valueRef field instead of
+// holding the value.
+//
+// The file of a value which is later overwritten or deleted, including by the server's TTL
+// monitor, is not removed with it: such files are reclaimed by PurgeLargeValues.
+func (db *MongoDB) valueUpdate(ctx context.Context, key, value []byte, expireAt time.Time) (bson.M, error) {
+	update := db.setUpdate(key, value, expireAt)
+	if len(value) <= maxInlineValueSize {
+		return update, nil
+	}
+
+	ctx, cancel := db.opContext(ctx)
+	defer cancel()
+	bucket, err := db.valueBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := bucket.UploadFromStream(hex.EncodeToString(key), bytes.NewReader(value))
+	if err != nil {
+		return nil, fmt.Errorf("uploading the value of key %X to GridFS: %w", key, err)
+	}
+
+	fields, unset := update["$set"].(bson.M), update["$unset"].(bson.M)
+	delete(fields, "value")
+	fields["valueRef"] = id[:]
+	delete(unset, "valueRef")
+	unset["value"] = ""
+	return update, nil
+}
+
+// documentValue returns the value of the key document doc, decoded with keyValueProjection,
+// downloading it from GridFS if the document references a file. An empty value is returned as a
+// non-nil empty slice, whether or not BSON decoding preserved it, so that it is distinct from the
+// nil of a missing key.
+func (db *MongoDB) documentValue(ctx context.Context, doc map[string][]byte) ([]byte, error) {
+	ref, ok := doc["valueRef"]
+	if !ok {
+		value, ok := doc["value"]
+		if ok && value == nil {
+			value = []byte{}
+		}
+		return value, nil
+	}
+	var id primitive.ObjectID
+	if len(ref) != len(id) {
+		return nil, fmt.Errorf("invalid GridFS reference %X of key %X", ref, doc["key"])
+	}
+	copy(id[:], ref)
+
+	ctx, cancel := db.opContext(ctx)
+	defer cancel()
+	bucket, err := db.valueBucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var value bytes.Buffer
+	if _, err := bucket.DownloadToStream(id, &value); err != nil {
+		return nil, fmt.Errorf("downloading the value of key %X from GridFS: %w", doc["key"], err)
+	}
+	return value.Bytes(), nil
+}
+
+// PurgeLargeValues removes the GridFS files of values which are no longer referenced by any key,
+// because the key was overwritten or deleted since, and returns how many were removed. Files
+// uploaded within the last hour are kept, as the write of their reference may still be in
+// progress.
+func (db *MongoDB) PurgeLargeValues(ctx context.Context) (int, error) {
+	if err := db.checkOpen(); err != nil {
+		return 0, err
+	}
+	// A file uploaded after the references are read is within the grace period, so it is kept
+	// even though its reference may have been missed.
+	cutoff := time.Now().Add(-largeValueGracePeriod)
+	referenced, err := db.valueRefs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	bucket, err := db.valueBucket(ctx)
+	if err != nil {
+		return 0, err
+	}
+	files, err := bucket.FindContext(ctx, bson.M{"uploadDate": bson.M{"$lt": cutoff}})
+	if err != nil {
+		return 0, err
+	}
+	defer files.Close(ctx)
+
+	purged := 0
+	for files.Next(ctx) {
+		var file struct {
+			ID primitive.ObjectID `bson:"_id"`
+		}
+		if err := files.Decode(&file); err != nil {
+			return purged, err
+		}
+		if referenced[string(file.ID[:])] {
+			continue
+		}
+		if err := bucket.DeleteContext(ctx, file.ID); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, files.Err()
+}
+
+// valueRefs returns the GridFS references of all key documents.
+func (db *MongoDB) valueRefs(ctx context.Context) (map[string]bool, error) {
+	cursor, err := db.syncCollection.Find(ctx, bson.M{"valueRef": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"_id": 0, "valueRef": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	refs := make(map[string]bool)
+	for cursor.Next(ctx) {
+		var doc map[string][]byte
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, err
+		}
+		refs[string(doc["valueRef"])] = true
+	}
+	return refs, cursor.Err()
+}
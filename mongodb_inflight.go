@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrTooManyInflightWrites is returned by asynchronous writes when MongoConfig.MaxInflightWrites
+// writes are already in flight and MongoConfig.RejectInflightWrites is set.
+var ErrTooManyInflightWrites = errors.New("too many in-flight mongodb writes")
+
+// inflightLimiter bounds the number of concurrent asynchronous writes.
+type inflightLimiter struct {
+	slots  chan struct{}
+	reject bool
+}
+
+func newInflightLimiter(max int, reject bool) *inflightLimiter {
+	return &inflightLimiter{slots: make(chan struct{}, max), reject: reject}
+}
+
+// acquire takes a slot for a write, blocking until one is free or ctx is done, or failing with
+// ErrTooManyInflightWrites if none is and the limiter rejects writes instead. The slot must be
+// given back with release once the write completes.
+func (l *inflightLimiter) acquire(ctx context.Context) error {
+	if !l.reject {
+		select {
+		case l.slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+		return ErrTooManyInflightWrites
+	}
+}
+
+func (l *inflightLimiter) release() {
+	<-l.slots
+}
+
+// acquireWrite takes an in-flight write slot if writes are bounded. It returns the function
+// giving the slot back.
+func (db *MongoDB) acquireWrite(ctx context.Context) (func(), error) {
+	if db.inflight == nil {
+		return func() {}, nil
+	}
+	if err := db.inflight.acquire(ctx); err != nil {
+		return nil, err
+	}
+	return db.inflight.release, nil
+}
@@ -4,69 +4,66 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
-	"log"
+	"errors"
+	"fmt"
 
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type MongoDBIterator struct {
+	db        *MongoDB
+	ctx       context.Context // Bounds the cursor's fetches of further documents
 	cursor    *mongo.Cursor
 	start     []byte
 	end       []byte
 	isReverse bool
 	isInvalid bool
-	lastErr   error
-	current   map[string][]byte
+	insertion bool              // Whether keys are walked in insertion order, which Seek cannot resume
+	lastErr   error             // Error decoding the current document or fetching its value
+	current   map[string][]byte // The current document, while the iterator is valid
+	closed    bool
 }
 
-func newMongoDBIterator(cursor *mongo.Cursor, start, end []byte, isReverse bool) *MongoDBIterator {
-	return &MongoDBIterator{
+// newMongoDBIterator returns an iterator over the documents of cursor, which must not have been
+// advanced yet, positioned on the first key of the domain [start, end), if any.
+func newMongoDBIterator(ctx context.Context, db *MongoDB, cursor *mongo.Cursor, start, end []byte,
+	isReverse bool) *MongoDBIterator {
+	db.iteratorOpened()
+	itr := &MongoDBIterator{
+		db:        db,
+		ctx:       ctx,
 		cursor:    cursor,
-		start:     start,
-		end:       end,
+		start:     copyBound(start),
+		end:       copyBound(end),
 		isReverse: isReverse,
 		isInvalid: false,
 	}
+	itr.advance()
+	return itr
 }
 
+// Domain implements Iterator. The iterator keeps its own copies of the bounds it was created with,
+// and returns new copies, so that neither the caller's slices nor the returned ones affect the
+// bounds it checks.
 func (itr *MongoDBIterator) Domain() ([]byte, []byte) {
-	return itr.start, itr.end
+	return copyBound(itr.start), copyBound(itr.end)
 }
 
-func (itr *MongoDBIterator) Valid() bool {
-	if itr.isInvalid {
-		return false
-	}
-
-	if err := itr.Error(); err != nil {
-		itr.isInvalid = true
-		return false
-	}
-
-	err := itr.cursor.Decode(&itr.current)
-	if err != nil {
-		itr.isInvalid = true
-		return false
-	}
-
-	key := itr.current["key"]
-
-	if itr.isReverse {
-		if itr.start != nil && bytes.Compare(key, itr.start) < 0 {
-			itr.isInvalid = true
-			return false
-		}
-	} else {
-		if itr.end != nil && bytes.Compare(itr.end, key) <= 0 {
-			itr.isInvalid = true
-			return false
-		}
+// copyBound returns a copy of the domain bound bound, keeping a nil bound open.
+func copyBound(bound []byte) []byte {
+	if bound == nil {
+		return nil
 	}
+	return cp(bound)
+}
 
-	return true
+// Valid implements Iterator. The current document is decoded and checked against the domain once,
+// when the iterator moves to it, so Valid is a cheap check which may be called any number of
+// times between calls to Next.
+func (itr *MongoDBIterator) Valid() bool {
+	return !itr.isInvalid
 }
 
 func (itr *MongoDBIterator) Key() []byte {
@@ -82,22 +79,160 @@ func (itr *MongoDBIterator) Value() []byte {
 func (itr *MongoDBIterator) Next() {
 	itr.assertIsValid()
 
-	if !itr.cursor.Next(context.Background()) {
+	prev := itr.current["key"]
+	itr.advance()
+	if key := itr.current["key"]; !itr.isInvalid && bytes.Equal(key, prev) {
+		itr.db.config.Logger.Error("Duplicate key found while iterating, the collection layout is inconsistent",
+			"key", hex.EncodeToString(key), "collection", itr.db.collectionName)
+	}
+}
+
+// advance moves the cursor to the next document and decodes it into current, or invalidates the
+// iterator if the cursor is exhausted or fails, or if the document lies beyond the domain. It is
+// the only method moving the cursor: the constructor calls it once to position the iterator on
+// the first document, and Next once per step, while Valid, Key and Value only look at the state
+// it leaves.
+func (itr *MongoDBIterator) advance() {
+	ctx, cancel := itr.db.opContext(itr.ctx)
+	defer cancel()
+
+	itr.current = nil
+	if !itr.cursor.Next(ctx) {
+		itr.isInvalid = true
+		return
+	}
+	if err := itr.cursor.Decode(&itr.current); err != nil {
+		itr.lastErr = err
 		itr.isInvalid = true
 		return
 	}
-	err := itr.cursor.Decode(&itr.current)
+
+	// The range filter already restricts the cursor to [start, end), so only the bound the
+	// iteration moves towards is checked: the exclusive end going forwards, and the inclusive
+	// start going backwards.
+	key := itr.current["key"]
+	if itr.isReverse {
+		itr.isInvalid = itr.start != nil && bytes.Compare(key, itr.start) < 0
+	} else {
+		itr.isInvalid = itr.end != nil && bytes.Compare(itr.end, key) <= 0
+	}
+	if itr.isInvalid {
+		return
+	}
+
+	value, err := itr.db.documentValue(ctx, itr.current)
+	if err != nil {
+		itr.lastErr = itr.db.closedError(err)
+		itr.isInvalid = true
+		return
+	}
+	itr.current["value"] = value
+}
+
+// Seek repositions the iterator on the first key of its domain at or after key, or for a reverse
+// iterator on the last key at or before key, as though it had been created with key as that bound;
+// the domain itself is unchanged. The driver cannot reposition a cursor, so Seek reissues the
+// query of the iterator with the adjusted bound and swaps in the new cursor, at the cost of a
+// round trip. It may move backwards as well as forwards, and makes an exhausted iterator valid
+// again if keys remain in the new range. As for a new iterator, failures to fetch the first key
+// are reported by Error.
+func (itr *MongoDBIterator) Seek(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if itr.closed {
+		return errors.New("iterator has been closed")
+	}
+	if itr.insertion {
+		return errors.New("cannot seek an iterator in insertion order")
+	}
+	if err := itr.db.checkOpen(); err != nil {
+		return err
+	}
+
+	start, end, direction := itr.start, itr.end, 1
+	if itr.isReverse {
+		direction = -1
+		// The smallest key after key, so that the exclusive end takes in key itself.
+		bound := append(cp(key), 0)
+		if end == nil || bytes.Compare(bound, end) < 0 {
+			end = bound
+		}
+	} else if start == nil || bytes.Compare(key, start) > 0 {
+		start = key
+	}
+	cursor, err := itr.db.findRange(itr.ctx, start, end, direction)
 	if err != nil {
-		log.Panic("unable to decode current cursor")
+		return err
+	}
+
+	ctx, cancel := itr.db.opContext(context.Background())
+	defer cancel()
+	// The old cursor is abandoned either way; the server reaps it if closing it fails.
+	if err := itr.cursor.Close(ctx); err != nil {
+		itr.db.config.Logger.Debug("Unable to close the cursor of a repositioned iterator, leaving it to the server",
+			"collection", itr.db.collectionName, "err", err)
+	}
+	itr.cursor = cursor
+	itr.lastErr = nil
+	itr.isInvalid = false
+	itr.advance()
+	return nil
+}
+
+// NextBatch returns up to max key/value pairs starting at the current position, and advances the
+// iterator past them, saving the per-call overhead of stepping through Valid, Key, Value and Next
+// for every pair. It returns fewer than max pairs only once the iterator is exhausted, after which
+// the iterator is invalid. NextBatch and Next may be mixed freely.
+func (itr *MongoDBIterator) NextBatch(max int) ([]KV, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("max must be positive, got %d", max)
+	}
+
+	batch := make([]KV, 0, max)
+	for len(batch) < max && itr.Valid() {
+		batch = append(batch, KV{Key: itr.current["key"], Value: itr.current["value"]})
+		itr.Next()
 	}
+	return batch, itr.Error()
 }
 
+// Error implements Iterator. Once the database is closed, a cursor failing because Close
+// disconnected the client reports ErrClosed.
 func (itr *MongoDBIterator) Error() error {
-	return itr.cursor.Err()
+	if itr.lastErr != nil {
+		return itr.lastErr
+	}
+	return iteratorError(itr.db.closedError(itr.cursor.Err()))
+}
+
+// ErrCursorNotFound is returned by MongoDBIterator.Error when the server cursor of the iterator
+// was discarded, typically because the iterator sat idle between calls to Next for longer than
+// the server's cursor timeout (cursorTimeoutMillis, 10 minutes by default).
+var ErrCursorNotFound = errors.New("iterator cursor not found on the server; it was probably idle beyond " +
+	"the server cursor timeout, so call Next more often, or set MongoConfig.NoCursorTimeout")
+
+// cursorNotFoundCode is the server error code of a cursor that does not exist.
+const cursorNotFoundCode = 43
+
+// iteratorError translates the cursor error err for the iterator.
+func iteratorError(err error) error {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == cursorNotFoundCode {
+		return fmt.Errorf("%w: %v", ErrCursorNotFound, err)
+	}
+	return err
 }
 
 func (itr *MongoDBIterator) Close() error {
-	return itr.cursor.Close(context.Background())
+	if itr.closed {
+		return nil
+	}
+	itr.closed = true
+	itr.db.iteratorClosed()
+	ctx, cancel := itr.db.opContext(context.Background())
+	defer cancel()
+	return itr.cursor.Close(ctx)
 }
 
 func (itr *MongoDBIterator) assertIsValid() {
@@ -106,59 +241,174 @@ func (itr *MongoDBIterator) assertIsValid() {
 	}
 }
 
-func (db *MongoDB) createIterator(start, end []byte, sortDirection int) (Iterator, error) {
-	var filter primitive.M
+func (db *MongoDB) createIterator(ctx context.Context, start, end []byte, sortDirection int) (Iterator, error) {
+	if err := db.checkOpen(); err != nil {
+		return nil, err
+	}
+	cursor, err := db.findRange(ctx, start, end, sortDirection)
+	if err != nil {
+		return nil, err
+	}
+
+	isReverse := sortDirection == -1
+	return newMongoDBIterator(ctx, db, cursor, start, end, isReverse), nil
+}
 
+// findRange returns a cursor over the documents of the keys in [start, end), walked in the given
+// direction, for an iterator bounded by ctx. The query runs through retry, so that Close waits
+// for it.
+func (db *MongoDB) findRange(ctx context.Context, start, end []byte, sortDirection int) (*mongo.Cursor, error) {
+	filter, err := rangeFilter(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := db.iteratorFindOptions(iteratorSort(sortDirection))
+	var cursor *mongo.Cursor
+	err = db.retry(func() (err error) {
+		findCtx, cancel := db.opContext(ctx)
+		defer cancel()
+		cursor, err = db.iterCollection.Find(findCtx, filter, opts)
+		return err
+	})
+	return cursor, err
+}
+
+// iteratorFindOptions returns the options of the query of an iterator walking keys in the order
+// of sort, as configured by MongoConfig.
+func (db *MongoDB) iteratorFindOptions(sort interface{}) *options.FindOptions {
+	opts := options.Find().SetSort(sort).SetProjection(keyValueProjection)
+	if db.config.NoCursorTimeout {
+		opts.SetNoCursorTimeout(true)
+	}
+	if db.config.IteratorBatchSize > 0 {
+		opts.SetBatchSize(db.config.IteratorBatchSize)
+	}
+	if comment := db.comment(); comment != "" {
+		opts.SetComment(comment)
+	}
+	return opts
+}
+
+// iteratorSort returns the sort specification of iterators walking keys in the given direction.
+// Keys are unique, but a collection written with an inconsistent layout may hold several
+// documents for a key; breaking ties by _id keeps the traversal of such documents deterministic.
+//
+// Keys are sorted by keyHex rather than by the binary key field, as the server orders binary
+// values by length before comparing their bytes. The lowercase hex encoding of keys compares as
+// strings exactly like bytes.Compare on the keys, since every byte maps to two digits whose ASCII
+// order is their numeric order.
+func iteratorSort(direction int) bson.D {
+	return bson.D{{Key: "keyHex", Value: direction}, {Key: "_id", Value: direction}}
+}
+
+// rangeFilter builds the query filter selecting the keys in the domain [start, end). A nil start
+// or end leaves that side of the domain open. Like iteratorSort, it compares keys by keyHex, so
+// that the filter agrees with the bytes.Compare bound checks of MongoDBIterator.Valid.
+func rangeFilter(start, end []byte) (bson.M, error) {
 	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
 		return nil, errKeyEmpty
 	}
 
 	switch {
 	case start == nil && end == nil:
-		filter = bson.M{}
+		// Leave out the metadata document, which has no key.
+		return bson.M{"key": bson.M{"$exists": true}}, nil
 	case start == nil:
-		filter = bson.M{
+		return bson.M{
 			"keyHex": bson.M{
 				"$lt": hex.EncodeToString(end),
 			},
-		}
+		}, nil
 	case end == nil:
-		filter = bson.M{
+		return bson.M{
 			"keyHex": bson.M{
 				"$gte": hex.EncodeToString(start),
 			},
-		}
-	// case strings.HasSuffix(string(start), "/"):
-	// 	filter = bson.M{
-	// 		"keyHex": bson.M{
-	// 			"$regex": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(hex.EncodeToString(start)), Options: ""},
-	// 		},
-	// 	}
+		}, nil
 	default:
-		filter = bson.M{
+		return bson.M{
 			"keyHex": bson.M{
 				"$gte": hex.EncodeToString(start),
 				"$lt":  hex.EncodeToString(end),
 			},
-		}
+		}, nil
+	}
+}
+
+// Iterator implements DB.
+//
+// The iterator streams documents from a server cursor walking the key index, which is not a
+// snapshot. Although the DB contract forbids it, keys deleted concurrently are tolerated: a key
+// deleted before the cursor reaches it is not returned, a key already returned stays returned,
+// and since the cursor only moves forward in key order no key is ever returned twice.
+func (db *MongoDB) Iterator(start, end []byte) (Iterator, error) {
+	return db.createIterator(context.Background(), start, end, 1)
+}
+
+// IteratorContext is like Iterator, but the iterator gives up once ctx is done, after which it is
+// invalid and Error returns the context error. The iterator must still be closed.
+func (db *MongoDB) IteratorContext(ctx context.Context, start, end []byte) (Iterator, error) {
+	return db.createIterator(ctx, start, end, 1)
+}
+
+// PrefixIterator returns an iterator over the keys starting with prefix, in ascending order. An
+// empty prefix iterates over all keys.
+func (db *MongoDB) PrefixIterator(prefix []byte) (Iterator, error) {
+	var start []byte
+	if len(prefix) > 0 {
+		start = cp(prefix)
 	}
+	return db.createIterator(context.Background(), start, prefixEnd(prefix), 1)
+}
 
-	opts := options.Find().SetSort(bson.M{"key": sortDirection}).SetProjection(bson.M{"_id": 0})
+// ReverseIterator implements DB. Concurrent deletes are handled as described on Iterator.
+func (db *MongoDB) ReverseIterator(start, end []byte) (Iterator, error) {
+	return db.createIterator(context.Background(), start, end, -1)
+}
 
-	cursor, err := db.collection.Find(context.Background(), filter, opts)
+// InsertionOrderIterator returns an iterator over all keys in the order in which they were first
+// inserted, rather than in key order. This is useful for stores with opaque keys whose
+// lexicographic order carries no meaning.
+//
+// The order is that of the server-generated ObjectId in each document's _id, which embeds a
+// creation timestamp and a counter; it does not depend on any custom key ordering. Overwriting a
+// key keeps its original position, while deleting and setting it again moves it to the end. With
+// MongoConfig.KeyAsID, the _id is the key itself, so the order is that of the keys as ordered by
+// the server instead: by length first, then bytewise.
+func (db *MongoDB) InsertionOrderIterator() (Iterator, error) {
+	opts := db.iteratorFindOptions(bson.M{"_id": 1})
+	filter, err := rangeFilter(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var cursor *mongo.Cursor
+	err = db.retry(func() (err error) {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		cursor, err = db.iterCollection.Find(ctx, filter, opts)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	cursor.Next(context.Background())
-	isReverse := sortDirection == -1
-	return newMongoDBIterator(cursor, start, end, isReverse), nil
+	itr := newMongoDBIterator(context.Background(), db, cursor, nil, nil, false)
+	itr.insertion = true
+	return itr, nil
 }
 
-func (db *MongoDB) Iterator(start, end []byte) (Iterator, error) {
-	return db.createIterator(start, end, 1)
+// OpenIterators returns the number of iterators that have been created and not yet closed.
+func (db *MongoDB) OpenIterators() int64 {
+	return db.openIterators.Load()
 }
 
-func (db *MongoDB) ReverseIterator(start, end []byte) (Iterator, error) {
-	return db.createIterator(start, end, -1)
+func (db *MongoDB) iteratorOpened() {
+	db.openIterators.Add(1)
+	db.config.Metrics.AddOpenIterators(1)
+}
+
+func (db *MongoDB) iteratorClosed() {
+	db.openIterators.Add(-1)
+	db.config.Metrics.AddOpenIterators(-1)
 }
@@ -0,0 +1,411 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// newTestMongoDBIterator returns an iterator over pairs, positioned as createIterator does, without
+// requiring a server. The pairs must be given in iteration order.
+func newTestMongoDBIterator(t *testing.T, db *MongoDB, pairs []KV, start, end []byte, reverse bool) *MongoDBIterator {
+	docs := make([]interface{}, 0, len(pairs))
+	for _, pair := range pairs {
+		docs = append(docs, bson.M{"key": pair.Key, "value": pair.Value})
+	}
+	cursor, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+	require.NoError(t, err)
+
+	return newMongoDBIterator(context.Background(), db, cursor, start, end, reverse)
+}
+
+// recordingMetrics is a Metrics recording every measurement.
+type recordingMetrics struct {
+	mtx           sync.Mutex
+	openIterators []int64
+}
+
+func (m *recordingMetrics) AddOpenIterators(delta int64) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.openIterators = append(m.openIterators, delta)
+}
+
+func (m *recordingMetrics) ObserveOperation(string, time.Duration, error) {}
+
+func TestMongoDBIteratorOpenIteratorsGauge(t *testing.T) {
+	metrics := &recordingMetrics{}
+	db := &MongoDB{config: MongoConfig{Metrics: metrics}}
+
+	pairs := []KV{{Key: []byte("a"), Value: []byte("1")}}
+	itr1 := newTestMongoDBIterator(t, db, pairs, nil, nil, false)
+	itr2 := newTestMongoDBIterator(t, db, pairs, nil, nil, false)
+	require.EqualValues(t, 2, db.OpenIterators())
+
+	require.NoError(t, itr1.Close())
+	require.EqualValues(t, 1, db.OpenIterators())
+	// Closing twice must not decrement again.
+	require.NoError(t, itr1.Close())
+	require.EqualValues(t, 1, db.OpenIterators())
+
+	require.NoError(t, itr2.Close())
+	require.Zero(t, db.OpenIterators())
+	require.Equal(t, []int64{1, 1, -1, -1}, metrics.openIterators)
+}
+
+func TestMongoDBIteratorSharedMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics, err := NewPrometheusMetrics(registry)
+	require.NoError(t, err)
+	db1 := &MongoDB{config: MongoConfig{Metrics: metrics}}
+	db2 := &MongoDB{config: MongoConfig{Metrics: metrics}}
+
+	pairs := []KV{{Key: []byte("a"), Value: []byte("1")}}
+	itr1 := newTestMongoDBIterator(t, db1, pairs, nil, nil, false)
+	itr2 := newTestMongoDBIterator(t, db2, pairs, nil, nil, false)
+	itr3 := newTestMongoDBIterator(t, db2, pairs, nil, nil, false)
+	require.Equal(t, 3.0, testutil.ToFloat64(metrics.openIterators))
+
+	require.NoError(t, itr1.Close())
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.openIterators))
+	require.NoError(t, itr2.Close())
+	require.NoError(t, itr3.Close())
+	require.Zero(t, testutil.ToFloat64(metrics.openIterators))
+}
+
+func TestMongoDBIteratorNextBatch(t *testing.T) {
+	db := &MongoDB{config: MongoConfig{Metrics: nopMetrics{}}}
+
+	pairs := make([]KV, 0, 10)
+	for i := 0; i < 10; i++ {
+		pairs = append(pairs, KV{Key: []byte{byte(i)}, Value: []byte{byte(i), byte(i)}})
+	}
+	itr := newTestMongoDBIterator(t, db, pairs, nil, nil, false)
+	defer itr.Close()
+
+	// Single steps mix with batches.
+	require.True(t, itr.Valid())
+	require.Equal(t, pairs[0].Key, itr.Key())
+	itr.Next()
+
+	var got []KV
+	for itr.Valid() {
+		batch, err := itr.NextBatch(4)
+		require.NoError(t, err)
+		require.NotEmpty(t, batch)
+		got = append(got, batch...)
+	}
+	require.Equal(t, pairs[1:], got)
+
+	batch, err := itr.NextBatch(4)
+	require.NoError(t, err)
+	require.Empty(t, batch)
+
+	_, err = itr.NextBatch(0)
+	require.Error(t, err)
+}
+
+func TestMongoDBIteratorDuplicateKeys(t *testing.T) {
+	logger := &capturingLogger{}
+	db := &MongoDB{config: MongoConfig{Metrics: nopMetrics{}, Logger: logger}}
+
+	// Ties on the key are broken by _id, in the direction of the iteration.
+	require.Equal(t, bson.D{{Key: "keyHex", Value: 1}, {Key: "_id", Value: 1}}, iteratorSort(1))
+	require.Equal(t, bson.D{{Key: "keyHex", Value: -1}, {Key: "_id", Value: -1}}, iteratorSort(-1))
+
+	itr := newTestMongoDBIterator(t, db, []KV{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("first")},
+		{Key: []byte("b"), Value: []byte("second")},
+		{Key: []byte("c"), Value: []byte("3")},
+	}, nil, nil, false)
+	defer itr.Close()
+
+	var values []string
+	for ; itr.Valid(); itr.Next() {
+		values = append(values, string(itr.Value()))
+	}
+	require.NoError(t, itr.Error())
+	require.Equal(t, []string{"1", "first", "second", "3"}, values)
+
+	lines := logger.Lines()
+	require.Len(t, lines, 1)
+	require.Contains(t, lines[0], "Duplicate key")
+	require.Contains(t, lines[0], "62") // hex of "b"
+}
+
+func TestMongoDBIteratorEmpty(t *testing.T) {
+	db := &MongoDB{config: MongoConfig{Metrics: nopMetrics{}}}
+
+	bounds := [][2][]byte{
+		{nil, nil},
+		{[]byte("a"), nil},
+		{nil, []byte("z")},
+		{[]byte("a"), []byte("z")},
+	}
+	for _, reverse := range []bool{false, true} {
+		for _, bound := range bounds {
+			itr := newTestMongoDBIterator(t, db, nil, bound[0], bound[1], reverse)
+			require.False(t, itr.Valid())
+			require.NoError(t, itr.Error())
+			checkInvalid(t, itr)
+			require.NoError(t, itr.Close())
+		}
+	}
+}
+
+func TestMongoDBKeyHexOrdering(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		keys := make([][]byte, 50)
+		for j := range keys {
+			// Short keys over a small alphabet make shared prefixes and 0x00/0xff bytes common.
+			keys[j] = make([]byte, rng.Intn(5)+1)
+			for k := range keys[j] {
+				keys[j][k] = []byte{0x00, 0x01, 0x7f, 0x80, 0xfe, 0xff}[rng.Intn(6)]
+			}
+		}
+
+		byBytes := append([][]byte(nil), keys...)
+		sort.Slice(byBytes, func(a, b int) bool { return bytes.Compare(byBytes[a], byBytes[b]) < 0 })
+		byHex := append([][]byte(nil), keys...)
+		sort.Slice(byHex, func(a, b int) bool { return hex.EncodeToString(byHex[a]) < hex.EncodeToString(byHex[b]) })
+		require.Equal(t, byBytes, byHex)
+	}
+}
+
+func TestMongoDBIteratorCursorNotFound(t *testing.T) {
+	err := iteratorError(mongo.CommandError{Code: 43, Name: "CursorNotFound", Message: "cursor id 1 not found"})
+	require.ErrorIs(t, err, ErrCursorNotFound)
+	require.Contains(t, err.Error(), "cursor id 1 not found")
+
+	other := mongo.CommandError{Code: 11600, Name: "InterruptedAtShutdown"}
+	require.Equal(t, other, iteratorError(other))
+	require.NoError(t, iteratorError(nil))
+}
+
+func TestDigestIterator(t *testing.T) {
+	db := NewMemDB()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, db.Set([]byte(key), []byte("value "+key)))
+	}
+	digest := func(start, end []byte) []byte {
+		itr, err := db.Iterator(start, end)
+		require.NoError(t, err)
+		defer itr.Close()
+		digest, err := digestIterator(itr)
+		require.NoError(t, err)
+		return digest
+	}
+
+	// Stable across runs.
+	full := digest(nil, nil)
+	require.Len(t, full, 32)
+	require.Equal(t, full, digest(nil, nil))
+	ranged := digest([]byte("b"), []byte("d"))
+	require.NotEqual(t, full, ranged)
+
+	// Changing a value inside the range changes the digest, changing one outside does not.
+	require.NoError(t, db.Set([]byte("c"), []byte("other")))
+	require.NotEqual(t, ranged, digest([]byte("b"), []byte("d")))
+	changed := digest([]byte("b"), []byte("d"))
+	require.NoError(t, db.Set([]byte("a"), []byte("other")))
+	require.Equal(t, changed, digest([]byte("b"), []byte("d")))
+
+	// Moving bytes between a key and its value changes the digest.
+	other := NewMemDB()
+	require.NoError(t, other.Set([]byte("ab"), []byte("c")))
+	require.NoError(t, db.Set([]byte("a"), []byte("bc")))
+	itrA, err := db.Iterator(nil, []byte("b"))
+	require.NoError(t, err)
+	defer itrA.Close()
+	itrB, err := other.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itrB.Close()
+	digestA, err := digestIterator(itrA)
+	require.NoError(t, err)
+	digestB, err := digestIterator(itrB)
+	require.NoError(t, err)
+	require.NotEqual(t, digestA, digestB)
+}
+
+func TestMongoDBClosedOperations(t *testing.T) {
+	db := &MongoDB{config: MongoConfig{Metrics: nopMetrics{}, Logger: nopLogger{}}}
+	itr := newTestMongoDBIterator(t, db, []KV{{Key: []byte("a"), Value: []byte("1")}}, nil, nil, false)
+	defer itr.Close()
+	// A cursor failing because Close disconnected the client under it.
+	cursor, err := mongo.NewCursorFromDocuments(nil, mongo.ErrClientDisconnected, nil)
+	require.NoError(t, err)
+	disconnected := newMongoDBIterator(context.Background(), db, cursor, nil, nil, false)
+	defer disconnected.Close()
+	require.ErrorIs(t, disconnected.Error(), mongo.ErrClientDisconnected)
+	require.NoError(t, db.Close())
+	require.NoError(t, db.Close())
+
+	_, err = db.Get([]byte("key"))
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.Has([]byte("key"))
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, db.SetSync([]byte("key"), []byte("value")), ErrClosed)
+	require.ErrorIs(t, db.Delete([]byte("key")), ErrClosed)
+	_, err = db.Iterator(nil, nil)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.ReverseIterator(nil, nil)
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, itr.Seek([]byte("a")), ErrClosed)
+	require.ErrorIs(t, disconnected.Error(), ErrClosed)
+	_, err = db.InsertionOrderIterator()
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.TTL([]byte("key"))
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.Increment([]byte("key"), 1)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.RecentKeys(1)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.RangeSize(nil, nil)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.CountByPrefixes([][]byte{[]byte("k")})
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.ShardDistribution()
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = db.Begin()
+	require.ErrorIs(t, err, ErrClosed)
+	require.ErrorIs(t, db.Migrate(), ErrClosed)
+}
+
+func TestMongoDBIteratorPositioning(t *testing.T) {
+	db := &MongoDB{config: MongoConfig{Metrics: nopMetrics{}, Logger: nopLogger{}}}
+
+	for _, n := range []int{0, 1, 2, 500} {
+		pairs := make([]KV, 0, n)
+		for i := 0; i < n; i++ {
+			pairs = append(pairs, KV{Key: int642Bytes(int64(i)), Value: []byte{byte(i)}})
+		}
+		for _, reverse := range []bool{false, true} {
+			docs := append([]KV(nil), pairs...)
+			if reverse {
+				for i, j := 0, len(docs)-1; i < j; i, j = i+1, j-1 {
+					docs[i], docs[j] = docs[j], docs[i]
+				}
+			}
+			itr := newTestMongoDBIterator(t, db, docs, nil, nil, reverse)
+
+			// Every key is returned exactly once, from the first to the last.
+			var got []KV
+			for ; itr.Valid(); itr.Next() {
+				got = append(got, KV{Key: itr.Key(), Value: itr.Value()})
+			}
+			require.NoError(t, itr.Error())
+			require.Equal(t, len(docs), len(got), "n=%d reverse=%v", n, reverse)
+			for i := range docs {
+				require.Equal(t, docs[i], got[i], "n=%d reverse=%v", n, reverse)
+			}
+			require.NoError(t, itr.Close())
+		}
+	}
+}
+
+func TestMongoDBIteratorDomainCopies(t *testing.T) {
+	db := &MongoDB{config: MongoConfig{Metrics: nopMetrics{}, Logger: nopLogger{}}}
+	pairs := []KV{
+		{Key: []byte("b"), Value: []byte("1")},
+		{Key: []byte("c"), Value: []byte("2")},
+		{Key: []byte("d"), Value: []byte("3")},
+	}
+	start, end := []byte("b"), []byte("d")
+	itr := newTestMongoDBIterator(t, db, pairs, start, end, false)
+	defer itr.Close()
+
+	// Mutating the caller's bounds, or those returned by Domain, leaves the domain unchanged.
+	start[0], end[0] = 'a', 'z'
+	domainStart, domainEnd := itr.Domain()
+	require.Equal(t, []byte("b"), domainStart)
+	require.Equal(t, []byte("d"), domainEnd)
+	domainStart[0], domainEnd[0] = 'a', 'z'
+	domainStart, domainEnd = itr.Domain()
+	require.Equal(t, []byte("b"), domainStart)
+	require.Equal(t, []byte("d"), domainEnd)
+
+	var keys []string
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	require.NoError(t, itr.Error())
+	require.Equal(t, []string{"b", "c"}, keys)
+
+	// Open bounds stay open.
+	open := newTestMongoDBIterator(t, db, pairs, nil, nil, false)
+	defer open.Close()
+	domainStart, domainEnd = open.Domain()
+	require.Nil(t, domainStart)
+	require.Nil(t, domainEnd)
+}
+
+func TestMongoDBIteratorRepeatedValid(t *testing.T) {
+	db := &MongoDB{config: MongoConfig{Metrics: nopMetrics{}, Logger: nopLogger{}}}
+	pairs := []KV{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("2")},
+		{Key: []byte("c"), Value: []byte("3")},
+	}
+	// The cursor holds a key beyond the end of the domain, as the server filter never returns.
+	itr := newTestMongoDBIterator(t, db, pairs, nil, []byte("c"), false)
+	defer itr.Close()
+
+	for _, pair := range pairs[:2] {
+		for i := 0; i < 3; i++ {
+			require.True(t, itr.Valid())
+			require.Equal(t, pair.Key, itr.Key())
+			require.Equal(t, pair.Value, itr.Value())
+		}
+		itr.Next()
+	}
+	for i := 0; i < 3; i++ {
+		require.False(t, itr.Valid())
+	}
+	require.NoError(t, itr.Error())
+	checkInvalid(t, itr)
+}
+
+func TestMongoDBIteratorDecodeError(t *testing.T) {
+	db := &MongoDB{config: MongoConfig{Metrics: nopMetrics{}, Logger: nopLogger{}}}
+	// The second document has a key which cannot be decoded into a byte slice.
+	docs := []interface{}{
+		bson.M{"key": []byte("a"), "value": []byte("1")},
+		bson.M{"key": int32(42), "value": []byte("2")},
+		bson.M{"key": []byte("c"), "value": []byte("3")},
+	}
+	cursor, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+	require.NoError(t, err)
+	itr := newMongoDBIterator(context.Background(), db, cursor, nil, nil, false)
+	defer itr.Close()
+
+	require.True(t, itr.Valid())
+	require.NoError(t, itr.Error())
+	require.Equal(t, []byte("a"), itr.Key())
+
+	// The decode failure invalidates the iterator rather than panicking, and is reported by Error.
+	require.NotPanics(t, itr.Next)
+	require.False(t, itr.Valid())
+	require.Error(t, itr.Error())
+	checkInvalid(t, itr)
+
+	// The first document fails to decode, so the iterator is invalid from the start.
+	cursor, err = mongo.NewCursorFromDocuments(docs[1:], nil, nil)
+	require.NoError(t, err)
+	itr = newMongoDBIterator(context.Background(), db, cursor, nil, nil, false)
+	defer itr.Close()
+	require.False(t, itr.Valid())
+	require.Error(t, itr.Error())
+}
@@ -0,0 +1,18 @@
+package db
+
+// Logger is used by the MongoDB backend to report noteworthy events. The keyvals are alternating
+// keys and values, which matches the CometBFT logger so that one can be passed in directly.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// nopLogger is a Logger discarding everything, used when no logger is configured.
+type nopLogger struct{}
+
+var _ Logger = nopLogger{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
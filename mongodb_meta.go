@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// metaID is the _id of the metadata document of a collection. The metadata document is stored
+// alongside the keys but has no key field, so it never matches key lookups or ranges.
+const metaID = "__cometbft_meta__"
+
+// ErrLayoutMismatch is returned when opening a collection whose documents were written with a
+// different layout than the one configured for the handle.
+var ErrLayoutMismatch = errors.New("collection layout does not match the configuration")
+
+// ErrSchemaVersion is returned when opening a collection recorded with a newer schema version
+// than currentSchemaVersion, whose documents this version of the package cannot read.
+var ErrSchemaVersion = errors.New("unsupported collection schema version")
+
+// currentSchemaVersion is the version of the encoding of the key documents written by this
+// version of the package, recorded in the metadata document of collections. The versions are:
+//
+//   - 0, unrecorded: collections created before the version was recorded, whose documents may
+//     store keys as strings in a keyString field.
+//   - 1: every key document stores its key as binary, indexed by keyHex.
+//
+// Opening a collection with a writable handle migrates it from older versions.
+const currentSchemaVersion = 1
+
+// modulePath is the module path of this package, whose version is recorded in the metadata
+// document of the collections it creates.
+const modulePath = "github.com/tuky191/cometbft-db"
+
+// collectionLayout describes how keys and values are laid out in the documents of a collection,
+// which must be the same for every handle opened on it.
+type collectionLayout struct {
+	// Values is where values are stored; "inline" in the key's document.
+	Values string `bson:"values"`
+	// KeyIndexField is the auxiliary field indexing keys for range scans.
+	KeyIndexField string `bson:"keyIndexField"`
+	// KeyField is "_id" if keys are the _id of their documents, or empty if they are only looked
+	// up by the key field, as in collections created before this was recorded.
+	KeyField string `bson:"keyField,omitempty"`
+}
+
+// metaDocument is the metadata document of a collection.
+type metaDocument struct {
+	ID     string           `bson:"_id"`
+	Layout collectionLayout `bson:"layout"`
+	// SchemaVersion is the schema version of the documents; see currentSchemaVersion.
+	SchemaVersion int `bson:"schemaVersion,omitempty"`
+	// LibraryVersion is the version of the package which created the collection, or empty if it
+	// was unknown.
+	LibraryVersion string `bson:"libraryVersion,omitempty"`
+}
+
+// libraryVersion returns the version of this module in the running binary, as recorded by the Go
+// toolchain, or "" if it is unknown, as in the module's own tests.
+func libraryVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return ""
+}
+
+// checkSchemaVersion returns ErrSchemaVersion if meta records a schema version newer than
+// currentSchemaVersion.
+func checkSchemaVersion(meta metaDocument) error {
+	if meta.SchemaVersion > currentSchemaVersion {
+		return fmt.Errorf("%w: collection uses version %d, but at most %d is supported", ErrSchemaVersion,
+			meta.SchemaVersion, currentSchemaVersion)
+	}
+	return nil
+}
+
+// layout returns the collection layout configured by cfg.
+func (cfg MongoConfig) layout() collectionLayout {
+	layout := collectionLayout{
+		Values:        "inline",
+		KeyIndexField: "keyHex",
+	}
+	if cfg.KeyAsID {
+		layout.KeyField = "_id"
+	}
+	return layout
+}
+
+// checkLayout records layout in the metadata document of collection if it has none yet, along
+// with the version of the package, and otherwise returns ErrLayoutMismatch if the recorded layout
+// is a different one, or ErrSchemaVersion if the recorded schema version is too new.
+func checkLayout(ctx context.Context, collection *mongo.Collection, layout collectionLayout) error {
+	var meta metaDocument
+	// Only setting the layout on insert makes concurrent opens of a new collection agree on the
+	// first recorded layout. The schema version is not set on insert, as the collection may hold
+	// documents written before the metadata document existed: upgradeSchema records it.
+	onInsert := bson.M{"layout": layout}
+	if version := libraryVersion(); version != "" {
+		onInsert["libraryVersion"] = version
+	}
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": metaID},
+		bson.M{"$setOnInsert": onInsert},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&meta)
+	if err != nil {
+		return err
+	}
+
+	if meta.Layout != layout {
+		return fmt.Errorf("%w: collection uses %+v, but %+v is configured", ErrLayoutMismatch, meta.Layout, layout)
+	}
+	return checkSchemaVersion(meta)
+}
+
+// verifyLayout is like checkLayout, but never writes to collection: a collection without a
+// recorded layout is accepted as is, and so is one with an older schema version, which is left
+// to writable handles to migrate.
+func verifyLayout(ctx context.Context, collection *mongo.Collection, layout collectionLayout) error {
+	var meta metaDocument
+	err := collection.FindOne(ctx, bson.M{"_id": metaID}).Decode(&meta)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if meta.Layout != layout {
+		return fmt.Errorf("%w: collection uses %+v, but %+v is configured", ErrLayoutMismatch, meta.Layout, layout)
+	}
+	return checkSchemaVersion(meta)
+}
+
+// upgradeSchema migrates the documents of the collection from the schema version recorded in its
+// metadata document to currentSchemaVersion, which it then records. Migrating is idempotent, so an
+// interrupted upgrade is resumed by the next open.
+func (db *MongoDB) upgradeSchema(ctx context.Context) error {
+	var meta metaDocument
+	if err := db.syncCollection.FindOne(ctx, bson.M{"_id": metaID}).Decode(&meta); err != nil {
+		return err
+	}
+	if err := checkSchemaVersion(meta); err != nil || meta.SchemaVersion == currentSchemaVersion {
+		return err
+	}
+
+	// From version 0: rewrite the documents with string keys.
+	if err := db.Migrate(); err != nil {
+		return fmt.Errorf("migrating from schema version %d: %w", meta.SchemaVersion, err)
+	}
+	_, err := db.syncCollection.UpdateOne(ctx, bson.M{"_id": metaID},
+		bson.M{"$max": bson.M{"schemaVersion": currentSchemaVersion}})
+	if err != nil {
+		return err
+	}
+	db.config.Logger.Info("Upgraded the collection schema", "from", meta.SchemaVersion,
+		"to", currentSchemaVersion, "collection", db.collectionName)
+	return nil
+}
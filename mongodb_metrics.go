@@ -0,0 +1,34 @@
+package db
+
+import "time"
+
+// Metrics receives measurements from the MongoDB backend, for instance to export them to
+// Prometheus. Implementations must be safe for concurrent use.
+type Metrics interface {
+	// AddOpenIterators reports a change of delta in the number of open iterators, each of which
+	// holds a server cursor: it is called with 1 whenever an iterator is created and with -1
+	// whenever one is closed, so a sum that keeps growing points at iterators that are never
+	// closed. Reporting changes rather than totals lets several databases share a Metrics.
+	AddOpenIterators(delta int64)
+
+	// ObserveOperation reports that the operation op, one of "get", "has", "multi_get", "set",
+	// "delete", "bulk_write", "increment" and "count", took duration including its retries, and failed with
+	// err unless it is nil.
+	ObserveOperation(op string, duration time.Duration, err error)
+}
+
+// nopMetrics is a Metrics discarding everything, used when no metrics are configured.
+type nopMetrics struct{}
+
+var _ Metrics = nopMetrics{}
+
+func (nopMetrics) AddOpenIterators(int64) {}
+
+func (nopMetrics) ObserveOperation(string, time.Duration, error) {}
+
+// observe reports the operation op, started at start, to the configured Metrics, with the error
+// *err it eventually failed with. It is meant to be deferred by operations with a named error
+// result.
+func (db *MongoDB) observe(op string, start time.Time, err *error) {
+	db.config.Metrics.ObserveOperation(op, time.Since(start), *err)
+}
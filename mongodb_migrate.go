@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// legacyDocument is a key document which may have been written by earlier versions, which stored
+// keys as strings in a keyString field rather than indexing binary keys by keyHex.
+type legacyDocument struct {
+	ID        interface{}   `bson:"_id"`
+	Key       bson.RawValue `bson:"key"`
+	KeyString *string       `bson:"keyString"`
+}
+
+// migrateBatchSize is the number of legacy documents Migrate reads at a time.
+const migrateBatchSize = 1000
+
+// legacyFilter selects the key documents not in the canonical layout: a binary key indexed by
+// keyHex, with no keyString.
+var legacyFilter = bson.M{
+	"_id": bson.M{"$ne": metaID},
+	"$or": bson.A{
+		bson.M{"key": bson.M{"$not": bson.M{"$type": "binData"}}},
+		bson.M{"keyHex": bson.M{"$exists": false}},
+		bson.M{"keyString": bson.M{"$exists": true}},
+	},
+}
+
+// Migrate rewrites the documents of the collection written by earlier versions into the canonical
+// layout, and logs how many were fixed. Documents already in the canonical layout are left
+// untouched, so Migrate is idempotent, and since every document is fixed on its own an
+// interrupted migration is resumed by running Migrate again. Writable handles run it when they
+// open a collection whose schema version predates the canonical layout.
+//
+// When both a legacy and a canonical document exist for a key, the canonical one was written
+// last and the legacy one is removed.
+func (db *MongoDB) Migrate() error {
+	opts := options.Find().SetSort(bson.M{"_id": 1}).SetLimit(migrateBatchSize)
+	fixed := 0
+	for {
+		// Fixed documents no longer match legacyFilter, so every batch starts from the first one
+		// left.
+		var docs []legacyDocument
+		err := db.retry(func() error {
+			ctx, cancel := db.opContext(context.Background())
+			defer cancel()
+			cursor, err := db.syncCollection.Find(ctx, legacyFilter, opts)
+			if err != nil {
+				return err
+			}
+			return cursor.All(ctx, &docs)
+		})
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		for _, doc := range docs {
+			key, err := doc.canonicalKey()
+			if err != nil {
+				return err
+			}
+			err = db.retry(func() error {
+				ctx, cancel := db.opContext(context.Background())
+				defer cancel()
+				return db.migrateDocument(ctx, doc.ID, key)
+			})
+			if err != nil {
+				return err
+			}
+			fixed++
+		}
+	}
+
+	db.config.Logger.Info("Migrated documents to the canonical layout", "fixed", fixed,
+		"collection", db.collectionName)
+	return nil
+}
+
+// canonicalKey returns the key of doc as stored in the canonical layout.
+func (doc legacyDocument) canonicalKey() ([]byte, error) {
+	switch doc.Key.Type {
+	case bsontype.Binary:
+		_, key := doc.Key.Binary()
+		return key, nil
+	case bsontype.String:
+		return []byte(doc.Key.StringValue()), nil
+	}
+	if doc.KeyString != nil {
+		return []byte(*doc.KeyString), nil
+	}
+	return nil, fmt.Errorf("document %v has no key", doc.ID)
+}
+
+// migrateDocument rewrites the document id to store key in the canonical layout, or removes it if
+// a canonical document for key already exists.
+func (db *MongoDB) migrateDocument(ctx context.Context, id interface{}, key []byte) error {
+	err := db.syncCollection.FindOne(ctx, bson.M{
+		"_id":       bson.M{"$ne": id},
+		"key":       key,
+		"keyHex":    bson.M{"$exists": true},
+		"keyString": bson.M{"$exists": false},
+	}).Err()
+	switch err {
+	case nil:
+		_, err = db.syncCollection.DeleteOne(ctx, bson.M{"_id": id})
+		return err
+	case mongo.ErrNoDocuments:
+	default:
+		return err
+	}
+
+	_, err = db.syncCollection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set":   bson.M{"key": key, "keyHex": hex.EncodeToString(key)},
+		"$unset": bson.M{"keyString": ""},
+	})
+	return err
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusMetrics is a Metrics exporting the measurements of the MongoDB backend to Prometheus:
+//
+//   - cometbft_db_mongodb_op_duration_seconds: a histogram of the duration of operations, by op.
+//   - cometbft_db_mongodb_op_errors_total: a counter of failed operations, by op.
+//   - cometbft_db_mongodb_open_iterators: a gauge of the number of open iterators.
+//
+// Databases only pay for metrics when configured with one in MongoConfig.Metrics. Several
+// databases may share a PrometheusMetrics, whose measurements then cover all of them: the gauge
+// then holds the total number of iterators they have open.
+type PrometheusMetrics struct {
+	duration      *prometheus.HistogramVec
+	errors        *prometheus.CounterVec
+	openIterators prometheus.Gauge
+}
+
+var _ Metrics = (*PrometheusMetrics)(nil)
+
+// NewPrometheusMetrics creates a PrometheusMetrics and registers its metrics with registerer. It
+// fails, registering none of them, if metrics of the same names are already registered.
+func NewPrometheusMetrics(registerer prometheus.Registerer) (*PrometheusMetrics, error) {
+	m := &PrometheusMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "cometbft_db",
+			Subsystem: "mongodb",
+			Name:      "op_duration_seconds",
+			Help:      "Duration of MongoDB backend operations, including retries.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"op"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "cometbft_db",
+			Subsystem: "mongodb",
+			Name:      "op_errors_total",
+			Help:      "Number of failed MongoDB backend operations.",
+		}, []string{"op"}),
+		openIterators: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "cometbft_db",
+			Subsystem: "mongodb",
+			Name:      "open_iterators",
+			Help:      "Number of open MongoDB backend iterators.",
+		}),
+	}
+	collectors := []prometheus.Collector{m.duration, m.errors, m.openIterators}
+	for i, c := range collectors {
+		if err := registerer.Register(c); err != nil {
+			for _, registered := range collectors[:i] {
+				registerer.Unregister(registered)
+			}
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// AddOpenIterators implements Metrics.
+func (m *PrometheusMetrics) AddOpenIterators(delta int64) {
+	m.openIterators.Add(float64(delta))
+}
+
+// ObserveOperation implements Metrics.
+func (m *PrometheusMetrics) ObserveOperation(op string, duration time.Duration, err error) {
+	m.duration.WithLabelValues(op).Observe(duration.Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(op).Inc()
+	}
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Stats implements DB. The returned keys are:
+//
+//   - database.type: "mongoDB".
+//   - mongodb.database: the name of the MongoDB database holding the collection.
+//   - mongodb.collection: the name of the collection.
+//   - mongodb.collection.count: the number of documents of the collection, including its
+//     metadata document.
+//   - mongodb.collection.size: the uncompressed size of the documents, in bytes.
+//   - mongodb.collection.storage_size: the storage allocated to the documents, in bytes.
+//   - mongodb.index.size: the total size of the indexes of the collection, in bytes.
+//   - mongodb.index.<name>.size: the size of the index <name>, in bytes.
+//   - mongodb.pool.open: the number of open connections of the client.
+//   - mongodb.pool.in_use: the number of connections checked out of the pool.
+//   - mongodb.pool.max_size: the maximum number of connections to each server, as configured by
+//     MongoConfig.MaxPoolSize or the URI, or 0 if unbounded. With a single server, operations
+//     wait for connections once in_use reaches it.
+//   - mongodb.pool.cleared: how many times the pool was cleared, which the driver does when it
+//     loses contact with a server.
+//   - mongodb.sessions.in_progress: the number of sessions in progress, left out for a database
+//     opened with NewMongoDBWithCollection.
+//   - mongodb.iterators.open: the number of open iterators, as returned by OpenIterators.
+//
+// The collection and index keys come from the storage statistics of the collection, summed over
+// all shards, and are left out if these cannot be read. The pool keys are shared by all databases
+// of a MongoDBFactory.
+func (db *MongoDB) Stats() map[string]string {
+	stats := map[string]string{
+		"database.type":          "mongoDB",
+		"mongodb.database":       db.databaseName,
+		"mongodb.collection":     db.collectionName,
+		"mongodb.iterators.open": strconv.FormatInt(db.OpenIterators(), 10),
+	}
+	if db.client != nil {
+		stats["mongodb.sessions.in_progress"] = strconv.Itoa(db.client.NumberSessionsInProgress())
+	}
+	if db.pool != nil {
+		stats["mongodb.pool.open"] = strconv.FormatInt(db.pool.open.Load(), 10)
+		stats["mongodb.pool.in_use"] = strconv.FormatInt(db.pool.inUse.Load(), 10)
+		stats["mongodb.pool.max_size"] = strconv.FormatUint(db.pool.maxSize, 10)
+		stats["mongodb.pool.cleared"] = strconv.FormatInt(db.pool.cleared.Load(), 10)
+	}
+
+	var storage collectionStorageStats
+	err := db.retry(func() (err error) {
+		ctx, cancel := db.opContext(context.Background())
+		defer cancel()
+		storage, err = db.storageStats(ctx)
+		return err
+	})
+	if err != nil {
+		db.config.Logger.Error("Unable to read the storage statistics of the collection",
+			"collection", db.collectionName, "err", err)
+		return stats
+	}
+	stats["mongodb.collection.count"] = strconv.FormatInt(storage.Count, 10)
+	stats["mongodb.collection.size"] = strconv.FormatInt(storage.Size, 10)
+	stats["mongodb.collection.storage_size"] = strconv.FormatInt(storage.StorageSize, 10)
+	stats["mongodb.index.size"] = strconv.FormatInt(storage.TotalIndexSize, 10)
+	for name, size := range storage.IndexSizes {
+		stats["mongodb.index."+name+".size"] = strconv.FormatInt(size, 10)
+	}
+	return stats
+}
+
+// collectionStorageStats holds the storage statistics of a collection reported by $collStats.
+type collectionStorageStats struct {
+	Count          int64            `bson:"count"`
+	Size           int64            `bson:"size"`
+	StorageSize    int64            `bson:"storageSize"`
+	TotalIndexSize int64            `bson:"totalIndexSize"`
+	IndexSizes     map[string]int64 `bson:"indexSizes"`
+}
+
+// storageStats returns the storage statistics of the collection, summed over all shards.
+func (db *MongoDB) storageStats(ctx context.Context) (collectionStorageStats, error) {
+	pipeline := mongo.Pipeline{{{Key: "$collStats", Value: bson.M{"storageStats": bson.M{}}}}}
+	cursor, err := db.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return collectionStorageStats{}, err
+	}
+	defer cursor.Close(ctx)
+
+	total := collectionStorageStats{IndexSizes: map[string]int64{}}
+	for cursor.Next(ctx) {
+		var shard struct {
+			StorageStats collectionStorageStats `bson:"storageStats"`
+		}
+		if err := cursor.Decode(&shard); err != nil {
+			return collectionStorageStats{}, err
+		}
+		total.Count += shard.StorageStats.Count
+		total.Size += shard.StorageStats.Size
+		total.StorageSize += shard.StorageStats.StorageSize
+		total.TotalIndexSize += shard.StorageStats.TotalIndexSize
+		for name, size := range shard.StorageStats.IndexSizes {
+			total.IndexSizes[name] += size
+		}
+	}
+	return total, cursor.Err()
+}
+
+// poolStats counts the connections of a client, fed by the pool monitor returned by monitor.
+type poolStats struct {
+	open    atomic.Int64
+	inUse   atomic.Int64
+	cleared atomic.Int64
+	maxSize uint64 // The maximum number of connections to each server, or 0 if unbounded
+}
+
+// defaultMaxPoolSize is the driver's default maximum number of connections to each server.
+const defaultMaxPoolSize = 100
+
+// monitor returns the pool monitor updating the statistics.
+func (p *poolStats) monitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: p.record}
+}
+
+func (p *poolStats) record(evt *event.PoolEvent) {
+	switch evt.Type {
+	case event.ConnectionCreated:
+		p.open.Add(1)
+	case event.ConnectionClosed:
+		p.open.Add(-1)
+	case event.GetSucceeded:
+		p.inUse.Add(1)
+	case event.ConnectionReturned:
+		p.inUse.Add(-1)
+	case event.PoolCleared:
+		p.cleared.Add(1)
+	}
+}
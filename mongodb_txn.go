@@ -0,0 +1,195 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+var (
+	// ErrTransactionsUnsupported is returned when starting a transaction on a deployment that
+	// does not support them, such as a standalone server.
+	ErrTransactionsUnsupported = errors.New("mongodb transactions require a replica set or a sharded cluster")
+
+	// errTxnDone is returned when a committed or rolled back transaction is used.
+	errTxnDone = errors.New("transaction has been committed or rolled back")
+)
+
+// MongoDBTxn is a multi-document MongoDB transaction. Reads within the transaction observe its own
+// writes, and the writes are applied atomically on Commit or discarded on Rollback. A MongoDBTxn
+// must not be used concurrently.
+type MongoDBTxn struct {
+	db      *MongoDB
+	session mongo.Session
+	ctx     mongo.SessionContext
+	done    bool
+}
+
+// Begin starts a transaction. The caller must call Commit or Rollback; Rollback is a no-op after
+// Commit, so it can be deferred.
+//
+// Transactions require a replica set or a sharded cluster: on a standalone server Begin returns
+// ErrTransactionsUnsupported. The server aborts transactions that run for longer than its
+// transactionLifetimeLimitSeconds (60 seconds by default), after which Commit fails.
+func (db *MongoDB) Begin() (*MongoDBTxn, error) {
+	ctx := context.Background()
+	err := db.retry(func() error {
+		ctx, cancel := db.opContext(ctx)
+		defer cancel()
+		return db.checkTransactionsSupported(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := db.client.StartSession()
+	if err != nil {
+		return nil, err
+	}
+	txnOpts := options.Transaction().
+		SetWriteConcern(db.config.WriteConcern).
+		SetReadPreference(readpref.Primary())
+	if err := session.StartTransaction(txnOpts); err != nil {
+		session.EndSession(ctx)
+		return nil, err
+	}
+
+	return &MongoDBTxn{
+		db:      db,
+		session: session,
+		ctx:     mongo.NewSessionContext(ctx, session),
+	}, nil
+}
+
+// checkTransactionsSupported returns ErrTransactionsUnsupported unless the deployment is a replica
+// set or a sharded cluster.
+func (db *MongoDB) checkTransactionsSupported(ctx context.Context) error {
+	if err := db.checkClient(); err != nil {
+		return err
+	}
+	standalone, err := isStandalone(ctx, db.client)
+	if err != nil {
+		return err
+	}
+	if standalone {
+		return ErrTransactionsUnsupported
+	}
+	return nil
+}
+
+// Get returns the value of the given key as seen by the transaction, or nil if it does not exist.
+// Like MongoDB.Get, it treats expired keys as missing.
+func (t *MongoDBTxn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errKeyEmpty
+	}
+	if t.done {
+		return nil, errTxnDone
+	}
+
+	var value []byte
+	projection := options.FindOne().SetProjection(keyValueProjection)
+	err := t.db.track(func() error {
+		ctx, cancel := t.db.opContext(t.ctx)
+		defer cancel()
+		var result map[string][]byte
+		err := t.db.collection.FindOne(ctx, unexpired(t.db.keyFilter(key)), projection).Decode(&result)
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err = t.db.documentValue(ctx, result)
+		return err
+	})
+	return value, err
+}
+
+// Set sets the value for the given key within the transaction.
+func (t *MongoDBTxn) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if err := t.db.validateKey(key); err != nil {
+		return err
+	}
+	if value == nil {
+		return errValueNil
+	}
+	if t.done {
+		return errTxnDone
+	}
+
+	return t.db.track(func() error {
+		update, err := t.db.valueUpdate(t.ctx, key, value, time.Time{})
+		if err != nil {
+			return err
+		}
+		ctx, cancel := t.db.opContext(t.ctx)
+		defer cancel()
+		result, err := t.db.collection.UpdateOne(ctx, t.db.keyFilter(key), update, options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+		return t.db.audit(t.ctx, mutation{key, value}, result.MatchedCount > 0)
+	})
+}
+
+// Delete deletes the given key within the transaction.
+func (t *MongoDBTxn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if err := t.db.validateKey(key); err != nil {
+		return err
+	}
+	if t.done {
+		return errTxnDone
+	}
+
+	return t.db.track(func() error {
+		ctx, cancel := t.db.opContext(t.ctx)
+		defer cancel()
+		result, err := t.db.collection.DeleteOne(ctx, t.db.keyFilter(key))
+		if err != nil {
+			return err
+		}
+		return t.db.audit(t.ctx, mutation{key: key}, result.DeletedCount > 0)
+	})
+}
+
+// Commit atomically applies the writes of the transaction.
+func (t *MongoDBTxn) Commit() error {
+	if t.done {
+		return errTxnDone
+	}
+	t.done = true
+	defer t.session.EndSession(context.Background())
+
+	return t.db.track(func() error {
+		ctx, cancel := t.db.opContext(context.Background())
+		defer cancel()
+		return t.session.CommitTransaction(ctx)
+	})
+}
+
+// Rollback discards the writes of the transaction. It does nothing if the transaction has already
+// been committed or rolled back.
+func (t *MongoDBTxn) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+	defer t.session.EndSession(context.Background())
+
+	return t.db.track(func() error {
+		ctx, cancel := t.db.opContext(context.Background())
+		defer cancel()
+		return t.session.AbortTransaction(ctx)
+	})
+}
@@ -0,0 +1,109 @@
+package db
+
+import "errors"
+
+// ErrReadOnly is returned when writing to a database opened read-only.
+var ErrReadOnly = errors.New("database is read-only")
+
+// ReadOnlyDB wraps another database, rejecting all writes with ErrReadOnly.
+type ReadOnlyDB struct {
+	db DB
+}
+
+var _ DB = (*ReadOnlyDB)(nil)
+
+// NewReadOnlyDB returns a read-only view of db. Reads and iterators are served by db, while
+// writes, including those of batches, fail with ErrReadOnly.
+func NewReadOnlyDB(db DB) *ReadOnlyDB {
+	return &ReadOnlyDB{db: db}
+}
+
+// Get implements DB.
+func (rdb *ReadOnlyDB) Get(key []byte) ([]byte, error) {
+	return rdb.db.Get(key)
+}
+
+// Has implements DB.
+func (rdb *ReadOnlyDB) Has(key []byte) (bool, error) {
+	return rdb.db.Has(key)
+}
+
+// Set implements DB.
+func (rdb *ReadOnlyDB) Set([]byte, []byte) error {
+	return ErrReadOnly
+}
+
+// SetSync implements DB.
+func (rdb *ReadOnlyDB) SetSync([]byte, []byte) error {
+	return ErrReadOnly
+}
+
+// Delete implements DB.
+func (rdb *ReadOnlyDB) Delete([]byte) error {
+	return ErrReadOnly
+}
+
+// DeleteSync implements DB.
+func (rdb *ReadOnlyDB) DeleteSync([]byte) error {
+	return ErrReadOnly
+}
+
+// Iterator implements DB.
+func (rdb *ReadOnlyDB) Iterator(start, end []byte) (Iterator, error) {
+	return rdb.db.Iterator(start, end)
+}
+
+// ReverseIterator implements DB.
+func (rdb *ReadOnlyDB) ReverseIterator(start, end []byte) (Iterator, error) {
+	return rdb.db.ReverseIterator(start, end)
+}
+
+// Close implements DB.
+func (rdb *ReadOnlyDB) Close() error {
+	return rdb.db.Close()
+}
+
+// NewBatch implements DB.
+func (rdb *ReadOnlyDB) NewBatch() Batch {
+	return readOnlyBatch{}
+}
+
+// Print implements DB.
+func (rdb *ReadOnlyDB) Print() error {
+	return rdb.db.Print()
+}
+
+// Stats implements DB.
+func (rdb *ReadOnlyDB) Stats() map[string]string {
+	return rdb.db.Stats()
+}
+
+// readOnlyBatch is the batch of a ReadOnlyDB, rejecting all writes.
+type readOnlyBatch struct{}
+
+var _ Batch = readOnlyBatch{}
+
+// Set implements Batch.
+func (readOnlyBatch) Set([]byte, []byte) error {
+	return ErrReadOnly
+}
+
+// Delete implements Batch.
+func (readOnlyBatch) Delete([]byte) error {
+	return ErrReadOnly
+}
+
+// Write implements Batch.
+func (readOnlyBatch) Write() error {
+	return ErrReadOnly
+}
+
+// WriteSync implements Batch.
+func (readOnlyBatch) WriteSync() error {
+	return ErrReadOnly
+}
+
+// Close implements Batch.
+func (readOnlyBatch) Close() error {
+	return nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyDB(t *testing.T) {
+	mem := NewMemDB()
+	require.NoError(t, mem.Set([]byte("a"), []byte("1")))
+	require.NoError(t, mem.Set([]byte("b"), []byte("2")))
+
+	db := NewReadOnlyDB(mem)
+	defer db.Close()
+
+	value, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	ok, err := db.Has([]byte("b"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	iter, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	checkItem(t, iter, []byte("a"), []byte("1"))
+	checkNext(t, iter, true)
+	checkItem(t, iter, []byte("b"), []byte("2"))
+	checkNext(t, iter, false)
+	require.NoError(t, iter.Close())
+
+	require.Equal(t, ErrReadOnly, db.Set([]byte("c"), []byte("3")))
+	require.Equal(t, ErrReadOnly, db.SetSync([]byte("c"), []byte("3")))
+	require.Equal(t, ErrReadOnly, db.Delete([]byte("a")))
+	require.Equal(t, ErrReadOnly, db.DeleteSync([]byte("a")))
+
+	batch := db.NewBatch()
+	require.Equal(t, ErrReadOnly, batch.Set([]byte("c"), []byte("3")))
+	require.Equal(t, ErrReadOnly, batch.Delete([]byte("a")))
+	require.Equal(t, ErrReadOnly, batch.Write())
+	require.Equal(t, ErrReadOnly, batch.WriteSync())
+	require.NoError(t, batch.Close())
+
+	// Nothing was written to the underlying database.
+	ok, err = mem.Has([]byte("c"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -34,6 +34,23 @@ func cpIncr(bz []byte) (ret []byte) {
 	return nil
 }
 
+// prefixEnd returns the exclusive upper bound of the keys starting with prefix: the shortest key
+// greater than all of them, obtained by dropping the trailing 0xFF bytes of prefix and
+// incrementing the last remaining one. It returns nil, an open bound, if prefix is empty or all
+// 0xFF bytes. Unlike cpIncr, it does not carry into trailing zero bytes, which would yield a bound
+// admitting keys without the prefix: the end of "a\xFF" is "b", not "b\x00".
+func prefixEnd(prefix []byte) []byte {
+	end := cp(prefix)
+	for len(end) > 0 {
+		if last := len(end) - 1; end[last] < 0xFF {
+			end[last]++
+			return end
+		}
+		end = end[:len(end)-1]
+	}
+	return nil
+}
+
 // See DB interface documentation for more information.
 func IsKeyInDomain(key, start, end []byte) bool {
 	if bytes.Compare(key, start) < 0 {
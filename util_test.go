@@ -120,3 +120,28 @@ func TestPrefixIteratorMatches1N(t *testing.T) {
 		})
 	}
 }
+
+func TestPrefixEnd(t *testing.T) {
+	testCases := []struct {
+		prefix []byte
+		end    []byte
+	}{
+		{nil, nil},
+		{[]byte{}, nil},
+		{[]byte("a"), []byte("b")},
+		{[]byte("a/"), []byte("a0")},
+		{[]byte{'a', 0xFF}, []byte("b")},
+		{[]byte{'a', 0xFF, 0xFF}, []byte("b")},
+		{[]byte{0x01, 0xFE}, []byte{0x01, 0xFF}},
+		{[]byte{0xFF}, nil},
+		{[]byte{0xFF, 0xFF}, nil},
+	}
+	for _, tc := range testCases {
+		require.Equal(t, tc.end, prefixEnd(tc.prefix), "prefix %X", tc.prefix)
+	}
+
+	// The prefix is not modified.
+	prefix := []byte{'a', 0xFF}
+	prefixEnd(prefix)
+	require.Equal(t, []byte{'a', 0xFF}, prefix)
+}